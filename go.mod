@@ -3,12 +3,15 @@ module tpush
 go 1.14
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/coreos/etcd v3.3.18+incompatible
 	github.com/go-redis/redis/v7 v7.2.0
+	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/golang/protobuf v1.3.4
 	github.com/gorilla/websocket v1.4.1
 	github.com/micro/cli/v2 v2.1.2
 	github.com/micro/go-micro/v2 v2.2.0
 	github.com/mitchellh/mapstructure v1.1.2
+	github.com/vmihailenco/msgpack v4.0.4+incompatible
 	golang.org/x/net v0.0.0-20200222125558-5a598a2470a0
 )
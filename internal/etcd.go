@@ -26,8 +26,11 @@ func GetDistributeNodes(cli *clientv3.Client, keys []string, timeout time.Durati
 	for i := 0; i < size; i++ {
 		go func(i int) {
 			defer close(dones[i])
-			log.Infof("PrefixKey: %#v", keys[i])
-			getRsp, err := cli.Get(ctxs[i], keys[i], clientv3.WithPrefix())
+			defer cancels[i]()
+			// 注册的key为"key/node"，补全分隔符避免"/chans/a"匹配到"/chans/ab/..."
+			prefix := keys[i] + "/"
+			log.Infof("PrefixKey: %#v", prefix)
+			getRsp, err := cli.Get(ctxs[i], prefix, clientv3.WithPrefix())
 			if err != nil {
 				log.Error(err)
 				return
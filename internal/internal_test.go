@@ -2,13 +2,37 @@ package internal
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/coreos/etcd/clientv3"
+	"github.com/go-redis/redis/v7"
+	"github.com/golang-jwt/jwt"
+	"github.com/golang/protobuf/proto"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/gorilla/websocket"
+	log "github.com/micro/go-micro/v2/logger"
+	"github.com/vmihailenco/msgpack"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	_ "net/http/pprof"
+	"os"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 	"tpush/internal/tchatroom"
+	"tpush/internal/tchatroom/wstest"
+	"tpush/internal/twebsocket"
+	pb "tpush/internal/twebsocket/proto/twebsocket"
 )
 
 func TestBIndex_RemoveUser(t *testing.T) {
@@ -104,3 +128,1412 @@ func TestGetDistributeNodes(t *testing.T) {
 	nodes := GetDistributeNodes(c, keys, time.Millisecond*1000)
 	t.Logf("%#v", nodes)
 }
+
+type fakeClient struct {
+	ctx context.Context
+}
+
+func (c *fakeClient) Write(cmd string, seq int64, data interface{}, code int32, msg string, opts ...twebsocket.WriteOption) int {
+	return 1
+}
+
+func (c *fakeClient) ContextValue(key interface{}) interface{} {
+	return c.ctx.Value(key)
+}
+
+func (c *fakeClient) AddContextValue(key, value interface{}) {
+	c.ctx = context.WithValue(c.ctx, key, value)
+}
+
+func (c *fakeClient) Batching() (time.Duration, int) {
+	return 0, 0
+}
+
+func (c *fakeClient) SetBatching(interval time.Duration, maxBatch int) {
+}
+
+func (c *fakeClient) Close() {
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{ctx: context.Background()}
+}
+
+type recordDistribute struct {
+	mu   sync.Mutex
+	keys map[string]int
+}
+
+func (d *recordDistribute) Register(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keys[key]++
+}
+
+func (d *recordDistribute) Unregister(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keys[key]--
+	if d.keys[key] == 0 {
+		delete(d.keys, key)
+	}
+}
+
+func (d *recordDistribute) Run() (stopFunc func()) {
+	return func() {}
+}
+
+func (d *recordDistribute) Registered(key string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.keys[key]
+}
+
+// 注册经refCountDistribute异步传递，等待计数变为want，超时返回当前计数
+func (d *recordDistribute) Wait(key string, want int) int {
+	n := d.Registered(key)
+	for i := 0; i < 100 && n != want; i++ {
+		time.Sleep(time.Millisecond * 10)
+		n = d.Registered(key)
+	}
+	return n
+}
+
+func newRecordDistribute() *recordDistribute {
+	return &recordDistribute{keys: make(map[string]int)}
+}
+
+func TestRefCountDistribute(t *testing.T) {
+	rd := newRecordDistribute()
+	d := tchatroom.NewRefCountDistribute(rd)
+
+	d.Register("/uids/1")
+	d.Register("/uids/1")
+	if n := rd.Wait("/uids/1", 1); n != 1 {
+		t.Fatalf("registered %d times, want 1", n)
+	}
+
+	d.Unregister("/uids/1")
+	if n := rd.Wait("/uids/1", 1); n != 1 {
+		t.Fatalf("unregistered while still referenced")
+	}
+
+	d.Unregister("/uids/1")
+	d.Unregister("/uids/1")
+	if n := rd.Wait("/uids/1", 0); n != 0 {
+		t.Fatalf("registered %d times, want 0", n)
+	}
+}
+
+// 底层实现阻塞直到release关闭，记录收到的操作顺序
+type blockingDistribute struct {
+	release chan struct{}
+	mu      sync.Mutex
+	ops     []string
+}
+
+func (d *blockingDistribute) record(op string) {
+	<-d.release
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ops = append(d.ops, op)
+}
+
+func (d *blockingDistribute) Register(key string) {
+	d.record("+" + key)
+}
+
+func (d *blockingDistribute) Unregister(key string) {
+	d.record("-" + key)
+}
+
+func (d *blockingDistribute) Run() (stopFunc func()) {
+	return func() {}
+}
+
+func (d *blockingDistribute) Ops() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.ops...)
+}
+
+func TestRefCountDistribute_Blocking(t *testing.T) {
+	bd := &blockingDistribute{release: make(chan struct{})}
+	d := tchatroom.NewRefCountDistribute(bd)
+
+	// 底层阻塞时注册/注销不阻塞调用方
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			d.Register("/ids/1")
+			d.Unregister("/ids/1")
+		}
+		d.Register("/ids/2")
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("caller blocked by inner distribute")
+	}
+
+	close(bd.release)
+	want := []string{"+/ids/1", "-/ids/1", "+/ids/1", "-/ids/1", "+/ids/1", "-/ids/1", "+/ids/2"}
+	var ops []string
+	for i := 0; i < 100; i++ {
+		if ops = bd.Ops(); len(ops) == len(want) {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !reflect.DeepEqual(ops, want) {
+		t.Fatalf("ops: %v", ops)
+	}
+}
+
+func TestRoom_MultiDeviceUser(t *testing.T) {
+	rd := newRecordDistribute()
+	room := tchatroom.NewRoom(rd, nil, nil)
+
+	userKey := fmt.Sprintf(tchatroom.RegUserKeyFmt, 1001)
+	chanKey := fmt.Sprintf(tchatroom.RegChannelKeyFmt, "world")
+
+	phone, browser := newFakeClient(), newFakeClient()
+	phoneId, browserId := room.AddClient(phone), room.AddClient(browser)
+	room.Login(phone, 1001)
+	room.Login(browser, 1001)
+	room.Login(browser, 1001)
+	room.ClientEnterChannel(phone, "world")
+	room.ClientEnterChannel(browser, "world")
+
+	if n := rd.Wait(userKey, 1); n != 1 {
+		t.Fatalf("user registered %d times, want 1", n)
+	}
+	if n := rd.Wait(chanKey, 1); n != 1 {
+		t.Fatalf("channel registered %d times, want 1", n)
+	}
+
+	room.RemoveClient(phone)
+	if n := rd.Wait(userKey, 1); n != 1 {
+		t.Fatal("user unregistered while another device is online")
+	}
+	if n := rd.Wait(chanKey, 1); n != 1 {
+		t.Fatal("channel unregistered while another member is online")
+	}
+	if n := rd.Wait(fmt.Sprintf(tchatroom.RegClientKeyFmt, phoneId), 0); n != 0 {
+		t.Fatal("removed client is still registered")
+	}
+	if n := rd.Wait(fmt.Sprintf(tchatroom.RegClientKeyFmt, browserId), 1); n != 1 {
+		t.Fatal("online client is not registered")
+	}
+	if _, ok := room.ClientsOfUser(1001); !ok {
+		t.Fatal("user has no clients")
+	}
+
+	room.RemoveClient(browser)
+	if n := rd.Wait(userKey, 0); n != 0 {
+		t.Fatal("user is still registered after all devices left")
+	}
+	if n := rd.Wait(chanKey, 0); n != 0 {
+		t.Fatal("channel is still registered after all members left")
+	}
+}
+
+// 不同协程(如连接本身与订阅/踢出RPC)并发让客户端进出同一频道
+// 索引变化与注册/注销的传递顺序须一致，最终不残留注册
+func TestRoom_ChannelRegisterOrder(t *testing.T) {
+	rd := newRecordDistribute()
+	room := tchatroom.NewRoom(rd, nil, nil)
+	chanKey := fmt.Sprintf(tchatroom.RegChannelKeyFmt, "x")
+
+	var wg sync.WaitGroup
+	clis := make([]*fakeClient, 4)
+	for i := range clis {
+		cli := newFakeClient()
+		room.AddClient(cli)
+		clis[i] = cli
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 2000; j++ {
+				room.ClientEnterChannel(cli, "x")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 2000; j++ {
+				room.ClientExitChannel(cli, "x")
+			}
+		}()
+	}
+	wg.Wait()
+	for _, cli := range clis {
+		room.ClientExitChannel(cli, "x")
+	}
+	if n := rd.Wait(chanKey, 0); n != 0 {
+		t.Fatalf("channel registered %d times after all members left", n)
+	}
+
+	cli := newFakeClient()
+	room.AddClient(cli)
+	room.ClientEnterChannel(cli, "x")
+	if n := rd.Wait(chanKey, 1); n != 1 {
+		t.Fatalf("channel registered %d times, want 1", n)
+	}
+}
+
+func waitNodes(store *tchatroom.MemoryStore, key string, want int) map[string]string {
+	var nodes map[string]string
+	for i := 0; i < 100; i++ {
+		if nodes = store.Nodes([]string{key}); len(nodes) == want {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return nodes
+}
+
+func TestMemoryDistribute_MultiNode(t *testing.T) {
+	store := tchatroom.NewMemoryStore()
+
+	nodes := []string{"node-a", "node-b"}
+	srvs := make([]*httptest.Server, len(nodes))
+	for i, node := range nodes {
+		d := tchatroom.NewMemoryDistribute(node, store)
+		defer d.Run()()
+		srvs[i] = httptest.NewServer(tchatroom.NewService(tchatroom.WithDistribute(d)))
+		defer srvs[i].Close()
+	}
+
+	a, _ := wstest.Login(t, srvs[0], 1001)
+	b1, _ := wstest.Login(t, srvs[1], 1002)
+	b2, _ := wstest.Login(t, srvs[1], 1002)
+	a.Request(tchatroom.CmdEnter, &tchatroom.EnterChanReq{Chans: []string{"world"}})
+	b1.Request(tchatroom.CmdEnter, &tchatroom.EnterChanReq{Chans: []string{"world"}})
+
+	if got := waitNodes(store, fmt.Sprintf(tchatroom.RegUserKeyFmt, 1001), 1); len(got) != 1 || got["node-a"] == "" {
+		t.Fatalf("user 1001 nodes: %v", got)
+	}
+	if got := waitNodes(store, fmt.Sprintf(tchatroom.RegUserKeyFmt, 1002), 1); len(got) != 1 || got["node-b"] == "" {
+		t.Fatalf("user 1002 nodes: %v", got)
+	}
+	if got := waitNodes(store, fmt.Sprintf(tchatroom.RegChannelKeyFmt, "world"), 2); len(got) != 2 {
+		t.Fatalf("channel nodes: %v", got)
+	}
+
+	// 一个设备离线后用户仍然可路由
+	b1.Conn.Close()
+	time.Sleep(time.Millisecond * 50)
+	if got := waitNodes(store, fmt.Sprintf(tchatroom.RegUserKeyFmt, 1002), 1); len(got) != 1 {
+		t.Fatalf("user 1002 nodes after one device left: %v", got)
+	}
+	if got := waitNodes(store, fmt.Sprintf(tchatroom.RegChannelKeyFmt, "world"), 1); len(got) != 1 || got["node-a"] == "" {
+		t.Fatalf("channel nodes after member left: %v", got)
+	}
+
+	b2.Conn.Close()
+	if got := waitNodes(store, fmt.Sprintf(tchatroom.RegUserKeyFmt, 1002), 0); len(got) != 0 {
+		t.Fatalf("user 1002 nodes after all devices left: %v", got)
+	}
+	a.Conn.Close()
+}
+
+func newHmacAuthenticator(t *testing.T, secret []byte) tchatroom.Authenticator {
+	a, err := tchatroom.NewHmacAuthenticator(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestHmacAuthenticator_Login(t *testing.T) {
+	if _, err := tchatroom.NewHmacAuthenticator(nil); err != tchatroom.ErrEmptyKey {
+		t.Fatalf("empty secret: %v", err)
+	}
+
+	secret := []byte("secret")
+	svc := tchatroom.NewService(tchatroom.WithAuthenticator(newHmacAuthenticator(t, secret)))
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+	url := wstest.URL(srv)
+
+	login := func(req *tchatroom.LoginReq) (*wstest.Client, *twebsocket.ResponseData) {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &wstest.Client{Conn: conn}
+		c.Request(tchatroom.CmdLogin, req)
+		rsp, err := c.Recv(tchatroom.CmdLogin, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, rsp
+	}
+
+	// uid以token中的为准
+	token := tchatroom.SignHmacToken(secret, 1001, time.Now().Add(time.Minute))
+	a, rsp := login(&tchatroom.LoginReq{Uid: 1002, Token: token})
+	defer a.Conn.Close()
+	if rsp.Code != 0 {
+		t.Fatalf("login code: %d", rsp.Code)
+	}
+	for i := 0; i < 100 && len(svc.Room.OnlineUsers([]int64{1001})) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if online := svc.Room.OnlineUsers([]int64{1001, 1002}); !reflect.DeepEqual(online, []int64{1001}) {
+		t.Fatalf("online users: %v", online)
+	}
+
+	for _, token := range []string{
+		tchatroom.SignHmacToken([]byte("forged"), 1001, time.Now().Add(time.Minute)),
+		tchatroom.SignHmacToken(secret, 1001, time.Now().Add(-time.Minute)),
+		"",
+	} {
+		b, rsp := login(&tchatroom.LoginReq{Uid: 1001, Token: token})
+		if rsp.Code != tchatroom.ErrLoginFailed {
+			t.Fatalf("login code: %d, want %d", rsp.Code, tchatroom.ErrLoginFailed)
+		}
+		if _, err := b.Recv(tchatroom.CmdLogin, time.Second); err == nil {
+			t.Fatal("connection not closed after login failed")
+		}
+		b.Conn.Close()
+	}
+}
+
+func writeTempFile(t *testing.T, data []byte) string {
+	f, err := ioutil.TempFile("", "tpush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestJwtAuthenticator(t *testing.T) {
+	hsKey := []byte("secret")
+	hsFile := writeTempFile(t, append(hsKey, '\n'))
+	defer os.Remove(hsFile)
+	hs, err := tchatroom.NewJwtHS256Authenticator(hsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := writeTempFile(t, []byte("\n"))
+	defer os.Remove(emptyFile)
+	if _, err := tchatroom.NewJwtHS256Authenticator(emptyFile); err != tchatroom.ErrEmptyKey {
+		t.Fatalf("empty key file: %v", err)
+	}
+
+	rsKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsFile := writeTempFile(t, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	defer os.Remove(rsFile)
+	rs, err := tchatroom.NewJwtRS256Authenticator(rsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+
+	cases := []struct {
+		auth  tchatroom.Authenticator
+		token string
+		uid   int64
+		ok    bool
+	}{
+		{hs, sign(jwt.SigningMethodHS256, hsKey, jwt.MapClaims{"uid": 1001, "exp": exp, "role": "admin"}), 1001, true},
+		{hs, sign(jwt.SigningMethodHS256, hsKey, jwt.MapClaims{"sub": "1002", "exp": exp}), 1002, true},
+		{hs, sign(jwt.SigningMethodHS256, []byte("forged"), jwt.MapClaims{"uid": 1001}), 0, false},
+		{hs, sign(jwt.SigningMethodHS256, hsKey, jwt.MapClaims{"uid": 1001}), 0, false},
+		{hs, sign(jwt.SigningMethodHS256, hsKey, jwt.MapClaims{"uid": 1001, "exp": time.Now().Add(-time.Minute).Unix()}), 0, false},
+		{rs, sign(jwt.SigningMethodRS256, rsKey, jwt.MapClaims{"uid": 1003, "exp": exp}), 1003, true},
+		// 防止用公钥作为HMAC密钥伪造
+		{rs, sign(jwt.SigningMethodHS256, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), jwt.MapClaims{"uid": 1003}), 0, false},
+	}
+	for i, c := range cases {
+		uid, attrs, err := c.auth.Authenticate(&tchatroom.LoginReq{Token: c.token})
+		if (err == nil) != c.ok || uid != c.uid {
+			t.Fatalf("case %d: uid %d, err %v", i, uid, err)
+		}
+		if i == 0 && attrs["role"] != "admin" {
+			t.Fatalf("attrs: %v", attrs)
+		}
+	}
+}
+
+func TestUpgradeAuth(t *testing.T) {
+	secret := []byte("secret")
+	svc := tchatroom.NewService(
+		tchatroom.WithAuthenticator(newHmacAuthenticator(t, secret)),
+		tchatroom.WithUpgradeAuth(true),
+	)
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+	url := wstest.URL(srv)
+
+	// 缺少或无效token返回401
+	for _, u := range []string{url, url + "?token=bad"} {
+		_, rsp, err := websocket.DefaultDialer.Dial(u, nil)
+		if err == nil || rsp == nil || rsp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("dial %s: %v, %v", u, rsp, err)
+		}
+	}
+
+	token := tchatroom.SignHmacToken(secret, 1001, time.Now().Add(time.Minute))
+	headers := []http.Header{
+		{"Authorization": []string{"Bearer " + token}},
+		{"Cookie": []string{tchatroom.TokenCookieName + "=" + token}},
+		nil,
+	}
+	for i, header := range headers {
+		u := url
+		if header == nil {
+			u += "?" + tchatroom.TokenQueryKey + "=" + token
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(u, header)
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		// 无需发送login，服务端主动下发登录结果
+		c := &wstest.Client{Conn: conn}
+		rsp, err := c.Recv(tchatroom.CmdLogin, time.Second)
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if rsp.Code != 0 {
+			t.Fatalf("case %d: login code %d", i, rsp.Code)
+		}
+		if online := svc.Room.OnlineUsers([]int64{1001}); len(online) != 1 {
+			t.Fatalf("case %d: online users %v", i, online)
+		}
+		conn.Close()
+	}
+}
+
+func TestWebsocketUpgraderOptions(t *testing.T) {
+	svc := tchatroom.NewService(tchatroom.WithWebsocketOptions(
+		twebsocket.WithAllowedOrigins("*.example.com", "example.org", "http://localhost:8080"),
+		twebsocket.WithSubprotocols("tpush.v1"),
+		twebsocket.WithReadLimit(64),
+	))
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+	url := wstest.URL(srv)
+
+	for origin, ok := range map[string]bool{
+		"":                           true,
+		"https://a.example.com":      true,
+		"https://a.example.com:8443": true,
+		"https://example.org:8443":   true,
+		"https://example.org":        true,
+		"http://localhost:8080":      true,
+		"http://localhost:8081":      false,
+		"https://evil.com":           false,
+	} {
+		header := http.Header{}
+		if len(origin) != 0 {
+			header.Set("Origin", origin)
+		}
+		conn, rsp, err := websocket.DefaultDialer.Dial(url, header)
+		if ok != (err == nil) {
+			t.Fatalf("origin %q: %v", origin, err)
+		}
+		if !ok && rsp.StatusCode != http.StatusForbidden {
+			t.Fatalf("origin %q: status %d", origin, rsp.StatusCode)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+
+	dialer := websocket.Dialer{Subprotocols: []string{"tpush.v0", "tpush.v1"}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != "tpush.v1" {
+		t.Fatalf("subprotocol: %q", conn.Subprotocol())
+	}
+
+	// 超过读取限制时关闭连接
+	c := &wstest.Client{Conn: conn}
+	c.Request(tchatroom.CmdLogin, &tchatroom.LoginReq{Uid: 1001, Token: strings.Repeat("x", 64)})
+	if _, err := c.Recv(tchatroom.CmdLogin, time.Second); err == nil {
+		t.Fatal("connection not closed after read limit exceeded")
+	}
+}
+
+func TestWebsocketCompression(t *testing.T) {
+	svc := tchatroom.NewService(tchatroom.WithWebsocketOptions(
+		twebsocket.WithCompression(true),
+		twebsocket.WithCompressionLevel(9),
+		twebsocket.WithCompressionThreshold(256),
+	))
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+	url := wstest.URL(srv)
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &wstest.Client{Conn: conn}
+	c.Request(tchatroom.CmdLogin, &tchatroom.LoginReq{Uid: 1001})
+	if _, err := c.Recv(tchatroom.CmdLogin, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && len(svc.Room.OnlineUsers([]int64{1001})) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	payload := strings.Repeat("compressible ", 1000)
+	svc.Room.SendToUsers([]int64{1001}, &tchatroom.RecvDataRsp{Data: payload}, true)
+	rsp, err := c.Recv(tchatroom.CmdRecvData, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data tchatroom.RecvDataRsp
+	if err := twebsocket.DecodeData(rsp.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Data != payload {
+		t.Fatal("payload mismatch")
+	}
+
+	// 登录响应低于阈值不压缩
+	stats := svc.Stats()
+	if stats.Frames != 2 || stats.CompressedFrames != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if ratio := stats.Ratio(); ratio <= 0 || ratio >= 0.5 {
+		t.Fatalf("compression ratio: %v", ratio)
+	}
+
+	// 统计及pprof仅在管理接口上提供
+	for _, pattern := range []string{tchatroom.StatsPattern, "/debug/pprof/"} {
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, httptest.NewRequest("GET", pattern, nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("%s served on public handler: %d", pattern, w.Code)
+		}
+		w = httptest.NewRecorder()
+		svc.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", pattern, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s on admin handler: %d", pattern, w.Code)
+		}
+	}
+}
+
+func TestWebsocketCodecs(t *testing.T) {
+	svc := tchatroom.NewService()
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+	url := wstest.URL(srv)
+
+	dial := func(subprotocol string) *websocket.Conn {
+		dialer := websocket.Dialer{Subprotocols: []string{subprotocol}}
+		conn, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.Subprotocol() != subprotocol {
+			t.Fatalf("subprotocol: %q, want %q", conn.Subprotocol(), subprotocol)
+		}
+		return conn
+	}
+
+	// msgpack
+	mp := dial(twebsocket.CodecMsgpack)
+	defer mp.Close()
+	var buf bytes.Buffer
+	msgpack.NewEncoder(&buf).UseJSONTag(true).Encode([]*twebsocket.RequestData{{Cmd: tchatroom.CmdLogin, Seq: 1, Data: &tchatroom.LoginReq{Uid: 1001}}})
+	if err := mp.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	mt, data, err := mp.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mpRsps []*twebsocket.ResponseData
+	if err := msgpack.NewDecoder(bytes.NewReader(data)).UseJSONTag(true).Decode(&mpRsps); err != nil {
+		t.Fatal(err)
+	}
+	if mt != websocket.BinaryMessage || len(mpRsps) != 1 || mpRsps[0].Cmd != tchatroom.CmdLogin || mpRsps[0].Seq != 1 {
+		t.Fatalf("msgpack response: %d, %+v", mt, mpRsps)
+	}
+	var login tchatroom.LoginRsp
+	if err := twebsocket.DecodeData(mpRsps[0].Data, &login); err != nil || login.Id == 0 {
+		t.Fatalf("msgpack login: %+v, %v", login, err)
+	}
+
+	// protobuf
+	pbc := dial(twebsocket.CodecProtobuf)
+	defer pbc.Close()
+	uid := &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: 1002}}
+	reqs, _ := proto.Marshal(&pb.Requests{Items: []*pb.Request{
+		{Cmd: tchatroom.CmdLogin, Seq: 1, Data: &structpb.Value{Kind: &structpb.Value_StructValue{StructValue: &structpb.Struct{
+			Fields: map[string]*structpb.Value{"uid": uid},
+		}}}},
+		{Cmd: tchatroom.CmdPing, Seq: 2},
+	}})
+	if err := pbc.WriteMessage(websocket.BinaryMessage, reqs); err != nil {
+		t.Fatal(err)
+	}
+	var pbRsps pb.Responses
+	for len(pbRsps.Items) == 0 {
+		mt, data, err := pbc.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mt != websocket.BinaryMessage {
+			t.Fatalf("message type: %d", mt)
+		}
+		if err := proto.Unmarshal(data, &pbRsps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for len(pbRsps.Items) < 2 {
+		_, data, err := pbc.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var more pb.Responses
+		if err := proto.Unmarshal(data, &more); err != nil {
+			t.Fatal(err)
+		}
+		pbRsps.Items = append(pbRsps.Items, more.Items...)
+	}
+	if pbRsps.Items[1].Cmd != tchatroom.CmdPing || pbRsps.Items[1].Seq != 2 {
+		t.Fatalf("protobuf response: %v", pbRsps.Items[1])
+	}
+	rsp := pbRsps.Items[0]
+	if rsp.Cmd != tchatroom.CmdLogin || rsp.Seq != 1 || rsp.Data.GetStructValue().GetFields()["id"].GetNumberValue() == 0 {
+		t.Fatalf("protobuf response: %v", rsp)
+	}
+	for i := 0; i < 100 && len(svc.Room.OnlineUsers([]int64{1001, 1002})) < 2; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// 不同编解码器的客户端接收同一推送
+	svc.Room.SendToUsers([]int64{1001, 1002}, &tchatroom.RecvDataRsp{Data: "hi"}, true)
+	_, data, err = mp.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpRsps = nil
+	if err := msgpack.NewDecoder(bytes.NewReader(data)).UseJSONTag(true).Decode(&mpRsps); err != nil {
+		t.Fatal(err)
+	}
+	var recv tchatroom.RecvDataRsp
+	if err := twebsocket.DecodeData(mpRsps[0].Data, &recv); err != nil || recv.Data != "hi" {
+		t.Fatalf("msgpack recv: %+v, %v", recv, err)
+	}
+	_, data, err = pbc.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbRsps.Reset()
+	if err := proto.Unmarshal(data, &pbRsps); err != nil {
+		t.Fatal(err)
+	}
+	if len(pbRsps.Items) != 1 || pbRsps.Items[0].Data.GetStructValue().GetFields()["data"].GetStringValue() != "hi" {
+		t.Fatalf("protobuf recv: %v", pbRsps.Items)
+	}
+}
+
+type typedTestReq struct {
+	Name string `json:"name"`
+}
+
+func (req *typedTestReq) Validate() error {
+	if len(req.Name) == 0 {
+		return fmt.Errorf("empty name")
+	}
+	return nil
+}
+
+type typedTestRsp struct {
+	Greeting string `json:"greeting"`
+}
+
+type typedTestKey struct{}
+
+func TestServeMux_Handle(t *testing.T) {
+	mux := twebsocket.NewServeMux()
+	mux.Handle("hello", func(ctx context.Context, cli twebsocket.Client, req *typedTestReq) (*typedTestRsp, error) {
+		if req.Name == "nobody" {
+			return nil, twebsocket.NewCodeError(-100, "no such user", false)
+		}
+		return &typedTestRsp{Greeting: ctx.Value(typedTestKey{}).(string) + " " + req.Name}, nil
+	})
+	mux.HandleFunc("legacy", func(req twebsocket.Request, rsp twebsocket.Response) error {
+		rsp.EncodeData(req.Command(), 0, "")
+		return nil
+	})
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("invalid handler registered")
+			}
+		}()
+		mux.Handle("bad", func(req *typedTestReq) error { return nil })
+	}()
+
+	ws := twebsocket.Server(
+		twebsocket.WithServeMux(mux),
+		twebsocket.WithOpenHandler(func(cli twebsocket.Client) error {
+			cli.AddContextValue(typedTestKey{}, "hello")
+			return nil
+		}),
+	)
+	ws.StartWritePumps(1)
+	srv := httptest.NewServer(ws)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &wstest.Client{Conn: conn}
+
+	for _, tc := range []struct {
+		cmd  string
+		data interface{}
+		code int32
+		want interface{}
+	}{
+		{"hello", &typedTestReq{Name: "tom"}, 0, map[string]interface{}{"greeting": "hello tom"}},
+		{"hello", &typedTestReq{}, twebsocket.CodeBadRequest, nil},
+		{"hello", "not an object", twebsocket.CodeBadRequest, nil},
+		{"hello", &typedTestReq{Name: "nobody"}, -100, nil},
+		{"legacy", nil, 0, "legacy"},
+	} {
+		c.Request(tc.cmd, tc.data)
+		rsp, err := c.Recv(tc.cmd, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.Code != tc.code || !reflect.DeepEqual(rsp.Data, tc.want) {
+			t.Fatalf("%s %v: code %d, msg %q, data %v", tc.cmd, tc.data, rsp.Code, rsp.Msg, rsp.Data)
+		}
+	}
+}
+
+func TestServeMux_Middleware(t *testing.T) {
+	var order []string
+	var mu sync.Mutex
+	trace := func(name string) twebsocket.Middleware {
+		return func(next twebsocket.HandlerFunc) twebsocket.HandlerFunc {
+			return func(req twebsocket.Request, rsp twebsocket.Response) error {
+				mu.Lock()
+				order = append(order, name+":"+req.Command())
+				mu.Unlock()
+				return next(req, rsp)
+			}
+		}
+	}
+	deny := func(next twebsocket.HandlerFunc) twebsocket.HandlerFunc {
+		return func(req twebsocket.Request, rsp twebsocket.Response) error {
+			return twebsocket.Error(rsp, -403, "denied", false)
+		}
+	}
+
+	mux := twebsocket.NewServeMux()
+	mux.Use(twebsocket.AccessLog(log.InfoLevel), twebsocket.Recovery(), trace("global"))
+	mux.HandleFunc("ping", func(req twebsocket.Request, rsp twebsocket.Response) error {
+		return nil
+	}, trace("ping"))
+	mux.HandleFunc("admin", func(req twebsocket.Request, rsp twebsocket.Response) error {
+		t.Error("denied handler called")
+		return nil
+	}, deny)
+	mux.Handle("panic", func(ctx context.Context, cli twebsocket.Client, req *typedTestReq) (*typedTestRsp, error) {
+		panic("boom")
+	})
+
+	ws := twebsocket.Server(twebsocket.WithServeMux(mux))
+	ws.StartWritePumps(1)
+	srv := httptest.NewServer(ws)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &wstest.Client{Conn: conn}
+
+	for _, tc := range []struct {
+		cmd  string
+		data interface{}
+		code int32
+	}{
+		{"panic", &typedTestReq{Name: "tom"}, twebsocket.CodeInternalError},
+		{"admin", nil, -403},
+		{"ping", nil, 0},
+	} {
+		c.Request(tc.cmd, tc.data)
+		rsp, err := c.Recv(tc.cmd, time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.cmd, err)
+		}
+		if rsp.Code != tc.code {
+			t.Fatalf("%s: code %d, msg %q", tc.cmd, rsp.Code, rsp.Msg)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"global:panic", "global:admin", "global:ping", "ping:ping"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("order: %v", order)
+	}
+}
+
+func TestServeMux_ChainOnce(t *testing.T) {
+	wraps := 0
+	counting := func(next twebsocket.HandlerFunc) twebsocket.HandlerFunc {
+		wraps++
+		return next
+	}
+
+	mux := twebsocket.NewServeMux()
+	mux.HandleFunc("ping", func(req twebsocket.Request, rsp twebsocket.Response) error {
+		return nil
+	})
+	// 后添加的全局中间件同样作用于已注册的命令
+	mux.Use(counting)
+	built := wraps
+	for i := 0; i < 3; i++ {
+		mux.Handler("ping")
+		mux.Handler("unknown")
+	}
+	if built != 2 || wraps != built {
+		t.Fatalf("middleware wrapped %d times, %d at registration", wraps, built)
+	}
+}
+
+// 连接到未启动写协程的服务，写入的消息均在队列中等待，由调用方启动写协程
+func newQueuedClient(t *testing.T, opts ...twebsocket.Option) (twebsocket.WritePumpHttpHandler, twebsocket.Client, *wstest.Client) {
+	opened := make(chan twebsocket.Client, 1)
+	ws := twebsocket.Server(append(opts, twebsocket.WithOpenHandler(func(cli twebsocket.Client) error {
+		opened <- cli
+		return nil
+	}))...)
+	srv := httptest.NewServer(ws)
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return ws, <-opened, &wstest.Client{Conn: conn}
+}
+
+// 读取一帧并返回其中各响应的序号
+func readSeqs(t *testing.T, c *wstest.Client) []int64 {
+	c.Conn.SetReadDeadline(time.Now().Add(time.Second))
+	var rsps []*twebsocket.ResponseData
+	if err := c.Conn.ReadJSON(&rsps); err != nil {
+		t.Fatal(err)
+	}
+	seqs := make([]int64, 0, len(rsps))
+	for _, rsp := range rsps {
+		seqs = append(seqs, rsp.Seq)
+	}
+	return seqs
+}
+
+func TestWriteQueueOverflow(t *testing.T) {
+	// 模拟停止读取的客户端
+	for policy, want := range map[twebsocket.OverflowPolicy][]int{
+		twebsocket.DropNewest: {1, 1, 0, 0, 0},
+		twebsocket.DropOldest: {1, 1, 1, 1, 1},
+	} {
+		ws, cli, c := newQueuedClient(t, twebsocket.WithWriteQueueLimit(2, 0, policy))
+		var got []int
+		for seq := int64(1); seq <= 5; seq++ {
+			got = append(got, cli.Write("rcvdata", seq, nil, 0, ""))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: written %v", policy, got)
+		}
+		if stats := ws.Stats(); stats.DroppedMessages != 3 {
+			t.Fatalf("%s: dropped %d", policy, stats.DroppedMessages)
+		}
+
+		ws.StartWritePumps(1)
+		seqs := readSeqs(t, c)
+		if wantSeqs := map[twebsocket.OverflowPolicy][]int64{
+			twebsocket.DropNewest: {1, 2},
+			twebsocket.DropOldest: {4, 5},
+		}[policy]; !reflect.DeepEqual(seqs, wantSeqs) {
+			t.Fatalf("%s: received %v", policy, seqs)
+		}
+	}
+
+	ws, cli, c := newQueuedClient(t, twebsocket.WithWriteQueueLimit(2, 0, twebsocket.Disconnect))
+	for seq := int64(1); seq <= 3; seq++ {
+		cli.Write("rcvdata", seq, nil, 0, "")
+	}
+	if n := cli.Write("rcvdata", 4, nil, 0, ""); n != 0 {
+		t.Fatal("written after disconnect")
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := c.Conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats := ws.Stats(); stats.SlowDisconnects != 1 || stats.DroppedMessages != 3 {
+		t.Fatalf("stats: %+v", stats)
+	}
+}
+
+func TestBatching(t *testing.T) {
+	ws, cli, c := newQueuedClient(t, twebsocket.WithBatching(time.Millisecond*100, 3))
+	ws.StartWritePumps(1)
+
+	// 达到最大批量时立即发送，余下的等待窗口到期
+	start := time.Now()
+	for seq := int64(1); seq <= 5; seq++ {
+		cli.Write("rcvdata", seq, nil, 0, "")
+	}
+	for _, want := range [][]int64{{1, 2, 3}, {4, 5}} {
+		if seqs := readSeqs(t, c); !reflect.DeepEqual(seqs, want) {
+			t.Fatalf("batch %v, want %v", seqs, want)
+		}
+	}
+	if cost := time.Since(start); cost < time.Millisecond*100 {
+		t.Fatalf("flushed before window: %v", cost)
+	}
+
+	// 登录时协商
+	svc := tchatroom.NewService(tchatroom.WithWebsocketOptions(twebsocket.WithBatching(time.Millisecond*100, 3)))
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(wstest.URL(srv), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c = &wstest.Client{Conn: conn}
+	c.Request(tchatroom.CmdLogin, &tchatroom.LoginReq{Uid: 1001, FlushInterval: 5000, MaxBatch: 2})
+	rsp, err := c.Recv(tchatroom.CmdLogin, time.Second*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loginRsp tchatroom.LoginRsp
+	if err := twebsocket.DecodeData(rsp.Data, &loginRsp); err != nil {
+		t.Fatal(err)
+	}
+	if loginRsp.FlushInterval != int64(tchatroom.MaxFlushInterval/time.Millisecond) || loginRsp.MaxBatch != 2 {
+		t.Fatalf("negotiated: %+v", loginRsp)
+	}
+}
+
+func TestConflation(t *testing.T) {
+	ws, cli, c := newQueuedClient(t)
+	for i, key := range []string{"btc", "eth", "", "btc", "btc", ""} {
+		var opts []twebsocket.WriteOption
+		if len(key) != 0 {
+			opts = append(opts, twebsocket.WithConflationKey(key))
+		}
+		cli.Write("rcvdata", int64(i+1), key, 0, "", opts...)
+	}
+	if stats := ws.Stats(); stats.ConflatedMessages != 2 {
+		t.Fatalf("conflated %d", stats.ConflatedMessages)
+	}
+
+	ws.StartWritePumps(1)
+	// 替换保留原位置
+	if seqs := readSeqs(t, c); !reflect.DeepEqual(seqs, []int64{5, 2, 3, 6}) {
+		t.Fatalf("received %v", seqs)
+	}
+
+	// 已发送的消息不再被替换
+	cli.Write("rcvdata", 7, "btc", 0, "", twebsocket.WithConflationKey("btc"))
+	if seqs := readSeqs(t, c); !reflect.DeepEqual(seqs, []int64{7}) {
+		t.Fatalf("received %v", seqs)
+	}
+}
+
+func TestWritePriority(t *testing.T) {
+	ws, cli, c := newQueuedClient(t, twebsocket.WithWriteQueueLimit(4, 0, twebsocket.DropOldest))
+	for seq, priority := range map[int64]twebsocket.Priority{
+		1: twebsocket.PriorityBulk,
+		2: twebsocket.PriorityNormal,
+		3: twebsocket.PriorityBulk,
+		4: twebsocket.PriorityHigh,
+	} {
+		cli.Write("rcvdata", seq, nil, 0, "", twebsocket.WithPriority(priority))
+	}
+	// 队列已满时丢弃最低优先级的消息，不为低优先级的新消息丢弃高优先级的
+	if n := cli.Write("rcvdata", 5, nil, 0, "", twebsocket.WithPriority(twebsocket.PriorityHigh)); n != 1 {
+		t.Fatal("high priority message dropped")
+	}
+	if n := cli.Write("rcvdata", 6, nil, 0, "", twebsocket.WithPriority(twebsocket.PriorityBulk)); n != 1 {
+		t.Fatal("bulk message dropped")
+	}
+	if stats := ws.Stats(); stats.DroppedMessages != 2 {
+		t.Fatalf("dropped %d", stats.DroppedMessages)
+	}
+
+	ws.StartWritePumps(1)
+	if seqs := readSeqs(t, c); !reflect.DeepEqual(seqs, []int64{4, 5, 2, 6}) {
+		t.Fatalf("received %v", seqs)
+	}
+
+	// 关闭前发出控制消息
+	cli.Write("notice", 7, nil, 0, "", twebsocket.WithPriority(twebsocket.PriorityControl))
+	cli.Close()
+	if seqs := readSeqs(t, c); !reflect.DeepEqual(seqs, []int64{7}) {
+		t.Fatalf("received %v", seqs)
+	}
+	if _, _, err := c.Conn.ReadMessage(); err == nil {
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestSnowflakeIdGenerator(t *testing.T) {
+	const node = 517
+	g := tchatroom.NewSnowflakeIdGenerator(node)
+
+	start := int64(time.Since(tchatroom.SnowflakeEpoch) / time.Second)
+	// 超过单秒序列号上限，耗尽后须等到下一秒
+	n := 5000
+	seen := make(map[int64]struct{}, n)
+	var last int64
+	for i := 0; i < n; i++ {
+		id := g.Next()
+		if id <= 0 || id >= 1<<53 {
+			t.Fatalf("id out of range: %d", id)
+		}
+		if id <= last {
+			t.Fatalf("id not increasing: %d after %d", id, last)
+		}
+		if _, ok := seen[id]; ok {
+			t.Fatalf("duplicate id: %d", id)
+		}
+		seen[id] = struct{}{}
+		last = id
+
+		if got := (id >> 12) & 1023; got != node {
+			t.Fatalf("node of %d: %d", id, got)
+		}
+	}
+
+	end := int64(time.Since(tchatroom.SnowflakeEpoch) / time.Second)
+	if ts := last >> 22; ts < start+1 || ts > end {
+		t.Fatalf("timestamp %d not in [%d, %d]", ts, start+1, end)
+	}
+}
+
+// 内存中的etcd，同一时刻只有一个有效租约，所有写入的key都挂在该租约上
+type fakeEtcd struct {
+	clientv3.KV
+	clientv3.Lease
+
+	mu        sync.Mutex
+	lease     clientv3.LeaseID
+	keepAlive chan *clientv3.LeaseKeepAliveResponse
+	keys      map[string]string
+	txns      []int // 每个事务的操作数
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{keys: make(map[string]string)}
+}
+
+func (f *fakeEtcd) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lease++
+	return &clientv3.LeaseGrantResponse{ID: f.lease, TTL: ttl}, nil
+}
+
+func (f *fakeEtcd) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keepAlive = make(chan *clientv3.LeaseKeepAliveResponse)
+	return f.keepAlive, nil
+}
+
+func (f *fakeEtcd) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys = make(map[string]string)
+	return &clientv3.LeaseRevokeResponse{}, nil
+}
+
+func (f *fakeEtcd) Txn(ctx context.Context) clientv3.Txn {
+	return &fakeTxn{f: f}
+}
+
+// 租约过期，挂在其上的key全部失效
+func (f *fakeEtcd) expire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	close(f.keepAlive)
+	f.keys = make(map[string]string)
+}
+
+func (f *fakeEtcd) Keys() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make(map[string]string, len(f.keys))
+	for k, v := range f.keys {
+		keys[k] = v
+	}
+	return keys
+}
+
+func (f *fakeEtcd) Txns() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int(nil), f.txns...)
+}
+
+type fakeTxn struct {
+	f   *fakeEtcd
+	ops []clientv3.Op
+}
+
+func (t *fakeTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	return t
+}
+
+func (t *fakeTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.ops = append(t.ops, ops...)
+	return t
+}
+
+func (t *fakeTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	return t
+}
+
+func (t *fakeTxn) Commit() (*clientv3.TxnResponse, error) {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	for _, op := range t.ops {
+		if op.IsPut() {
+			t.f.keys[string(op.KeyBytes())] = string(op.ValueBytes())
+		} else if op.IsDelete() {
+			delete(t.f.keys, string(op.KeyBytes()))
+		}
+	}
+	t.f.txns = append(t.f.txns, len(t.ops))
+	return &clientv3.TxnResponse{}, nil
+}
+
+func waitEtcdKeys(f *fakeEtcd, want int) map[string]string {
+	var keys map[string]string
+	for i := 0; i < 300; i++ {
+		if keys = f.Keys(); len(keys) == want {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return keys
+}
+
+func TestEtcdDistribute_Batching(t *testing.T) {
+	f := newFakeEtcd()
+	d := tchatroom.NewEtcdDistribute("node-a", f, time.Second*5)
+
+	// 启动前的注册/注销在首次提交时合并，新租约上只写入仍注册的key，超出单个事务上限的分批提交
+	for i := 0; i < 300; i++ {
+		d.Register(fmt.Sprintf(tchatroom.RegClientKeyFmt, i))
+	}
+	for i := 0; i < 100; i++ {
+		d.Unregister(fmt.Sprintf(tchatroom.RegClientKeyFmt, i))
+	}
+	d.Unregister("/ids/never-registered")
+	stop := d.Run()
+
+	var txns []int
+	total := 0
+	for i := 0; i < 100 && total < 200; i++ {
+		time.Sleep(time.Millisecond * 10)
+		txns, total = f.Txns(), 0
+		for _, n := range txns {
+			total += n
+		}
+	}
+	if total != 200 || len(txns) != 2 {
+		t.Fatalf("committed %d ops in %v", total, txns)
+	}
+	for _, n := range txns {
+		if n > 128 {
+			t.Fatalf("txn with %d ops", n)
+		}
+	}
+	keys := f.Keys()
+	if len(keys) != 200 || keys[fmt.Sprintf(tchatroom.RegClientKeyFmt, 299)+"/node-a"] != "node-a" {
+		t.Fatalf("registered %d keys", len(keys))
+	}
+
+	stop()
+	if keys := f.Keys(); len(keys) != 0 {
+		t.Fatalf("keys after stop: %d", len(keys))
+	}
+}
+
+func TestEtcdDistribute_LeaseLost(t *testing.T) {
+	f := newFakeEtcd()
+	d := tchatroom.NewEtcdDistribute("node-a", f, time.Second*5)
+	stop := d.Run()
+	defer stop()
+
+	d.Register("/uids/1")
+	d.Register("/chans/a/b")
+	if keys := waitEtcdKeys(f, 2); len(keys) != 2 {
+		t.Fatalf("keys: %v", keys)
+	}
+
+	// 租约丢失后重新申请并注册全部key
+	f.expire()
+	d.Unregister("/chans/a/b")
+	keys := waitEtcdKeys(f, 1)
+	if _, ok := keys["/uids/1/node-a"]; !ok || len(keys) != 1 {
+		t.Fatalf("keys after lease lost: %v", keys)
+	}
+}
+
+func TestRedisDistribute(t *testing.T) {
+	s := miniredis.RunT(t)
+	cli := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer cli.Close()
+
+	d := tchatroom.NewRedisDistribute("node-a", cli, time.Second*5)
+	stop := d.Run()
+	stopped := false
+	defer func() {
+		if !stopped {
+			stop()
+		}
+	}()
+
+	isMember := func(key, node string) bool {
+		ok, _ := s.IsMember(key, node)
+		return ok
+	}
+	waitMember := func(key, node string, want bool) bool {
+		for i := 0; i < 300 && isMember(key, node) != want; i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		return isMember(key, node) == want
+	}
+
+	d.Register("/uids/1")
+	d.Register("/chans/a/b")
+	d.Unregister("/chans/a/b")
+	if !waitMember("/uids/1", "node-a", true) || isMember("/chans/a/b", "node-a") {
+		t.Fatal("unexpected registration")
+	}
+	if nodes := GetRedisDistributeNodes(cli, []string{"/uids/1"}, time.Second); nodes["node-a"] != "/uids/1" {
+		t.Fatalf("nodes: %v", nodes)
+	}
+
+	// redis数据丢失后在下次心跳时重新注册，并清理心跳已过期节点的成员
+	s.FlushAll()
+	s.SetAdd(tchatroom.RegNodeSetKey, "node-b")
+	s.SetAdd(fmt.Sprintf(tchatroom.RegNodeIndexKeyFmt, "node-b"), "/uids/2")
+	s.SetAdd("/uids/2", "node-b")
+	if !waitMember("/uids/1", "node-a", true) {
+		t.Fatal("not registered again after heartbeat lost")
+	}
+	if !waitMember("/uids/2", "node-b", false) {
+		t.Fatal("dead node not swept")
+	}
+	if s.Exists(fmt.Sprintf(tchatroom.RegNodeIndexKeyFmt, "node-b")) || isMember(tchatroom.RegNodeSetKey, "node-b") {
+		t.Fatal("dead node index not removed")
+	}
+
+	stop()
+	stopped = true
+	if isMember("/uids/1", "node-a") || s.Exists(fmt.Sprintf(tchatroom.RegNodeKeyFmt, "node-a")) {
+		t.Fatalf("keys after stop: %v", s.Keys())
+	}
+}
+
+func TestRedisNodeIdClaimer(t *testing.T) {
+	s := miniredis.RunT(t)
+	cli := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer cli.Close()
+
+	node := tchatroom.SnowflakeNode("server-a")
+	if node != tchatroom.SnowflakeNode("server-a") || node < 0 || node > tchatroom.SnowflakeMaxNode {
+		t.Fatalf("derived node: %d", node)
+	}
+
+	a := tchatroom.NewRedisNodeIdClaimer("node-a", cli, time.Second*5)
+	if got, err := tchatroom.ClaimSnowflakeNode(a, node, false); err != nil || got != node {
+		t.Fatalf("claim: %d %v", got, err)
+	}
+	stop := a.Run()
+
+	// 推导的节点号被占用时顺延，指定的节点号被占用时失败
+	b := tchatroom.NewRedisNodeIdClaimer("node-b", cli, time.Second*5)
+	if got, err := tchatroom.ClaimSnowflakeNode(b, node, false); err != nil || got != (node+1)&tchatroom.SnowflakeMaxNode {
+		t.Fatalf("claim derived: %d %v", got, err)
+	}
+	if _, err := tchatroom.ClaimSnowflakeNode(tchatroom.NewRedisNodeIdClaimer("node-c", cli, time.Second*5), node, true); err == nil {
+		t.Fatal("claimed a taken node id")
+	}
+
+	key := fmt.Sprintf(tchatroom.RegSnowflakeKeyFmt, node)
+	if v, _ := s.Get(key); v != "node-a" {
+		t.Fatalf("owner: %s", v)
+	}
+	stop()
+	if s.Exists(key) {
+		t.Fatal("node id not released after stop")
+	}
+}
+
+func TestRedisSubscriptionStore(t *testing.T) {
+	s := miniredis.RunT(t)
+	cli := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer cli.Close()
+
+	// 先启动的节点保存持久订阅，之后启动的节点登录时读取
+	a := tchatroom.NewRoom(nil, nil, tchatroom.NewRedisSubscriptionStore(cli))
+	if _, err := a.SubscribeUser([]int64{1001, 1002}, []string{"room/1", "news", ""}, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.UnsubscribeUser([]int64{1002}, []string{"news"}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := tchatroom.NewRoom(nil, nil, tchatroom.NewRedisSubscriptionStore(cli))
+	for uid, want := range map[int64][]string{1001: {"news", "room/1"}, 1002: {"room/1"}} {
+		c := newFakeClient()
+		id := b.AddClient(c)
+		b.Login(c, uid)
+		chs, _ := b.ChannelsOfClient(id)
+		sort.Strings(chs)
+		if !reflect.DeepEqual(chs, want) {
+			t.Fatalf("channels of %d: %v, want %v", uid, chs, want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	log "github.com/micro/go-micro/v2/logger"
+	"time"
+	"tpush/internal/tchatroom"
+)
+
+// 与GetDistributeNodes等价，查询注册在redis中的节点，并过滤掉心跳已过期的节点
+func GetRedisDistributeNodes(cli *redis.Client, keys []string, timeout time.Duration) map[string]string {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cli = cli.WithContext(ctx)
+
+	// multi requests
+	cmds := make([]*redis.StringSliceCmd, len(keys))
+	_, err := cli.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			log.Infof("Key: %#v", key)
+			cmds[i] = pipe.SMembers(key)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return map[string]string{}
+	}
+
+	nodes := make(map[string]string)
+	for i, cmd := range cmds {
+		for _, node := range cmd.Val() {
+			nodes[node] = keys[i]
+		}
+	}
+
+	// 过滤心跳已过期的节点
+	alives := make(map[string]*redis.IntCmd, len(nodes))
+	_, err = cli.Pipelined(func(pipe redis.Pipeliner) error {
+		for node := range nodes {
+			alives[node] = pipe.Exists(fmt.Sprintf(tchatroom.RegNodeKeyFmt, node))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return map[string]string{}
+	}
+
+	ret := make(map[string]string, len(nodes))
+	for node, key := range nodes {
+		if alives[node].Val() > 0 {
+			log.Infof("Key: %s, Node: %s", key, node)
+			ret[node] = key
+		}
+	}
+	return ret
+}
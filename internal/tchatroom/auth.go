@@ -0,0 +1,158 @@
+package tchatroom
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+	ErrEmptyKey     = errors.New("empty authentication key")
+)
+
+// 登录认证，返回校验后的uid及附加属性
+type Authenticator interface {
+	Authenticate(req *LoginReq) (uid int64, attrs map[string]interface{}, err error)
+}
+
+type AuthenticatorFunc func(req *LoginReq) (int64, map[string]interface{}, error)
+
+func (f AuthenticatorFunc) Authenticate(req *LoginReq) (int64, map[string]interface{}, error) {
+	return f(req)
+}
+
+// HMAC签名token，格式为"uid.过期时间戳.hex(HMAC-SHA256(uid.过期时间戳))"
+type hmacAuthenticator struct {
+	secret []byte
+}
+
+func hmacSign(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 供业务后端签发token
+func SignHmacToken(secret []byte, uid int64, expire time.Time) string {
+	payload := fmt.Sprintf("%d.%d", uid, expire.Unix())
+	return payload + "." + hmacSign(secret, payload)
+}
+
+func (a *hmacAuthenticator) Authenticate(req *LoginReq) (int64, map[string]interface{}, error) {
+	i := strings.LastIndexByte(req.Token, '.')
+	if i < 0 {
+		return 0, nil, ErrInvalidToken
+	}
+	payload, sig := req.Token[:i], req.Token[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(hmacSign(a.secret, payload))) {
+		return 0, nil, ErrInvalidToken
+	}
+
+	parts := strings.Split(payload, ".")
+	if len(parts) != 2 {
+		return 0, nil, ErrInvalidToken
+	}
+	uid, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, nil, ErrInvalidToken
+	}
+	expire, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, nil, ErrInvalidToken
+	}
+	if time.Now().Unix() > expire {
+		return 0, nil, ErrTokenExpired
+	}
+	return uid, map[string]interface{}{"exp": expire}, nil
+}
+
+// 空密钥可伪造任意token，返回错误
+func NewHmacAuthenticator(secret []byte) (Authenticator, error) {
+	if len(secret) == 0 {
+		return nil, ErrEmptyKey
+	}
+	return &hmacAuthenticator{secret: secret}, nil
+}
+
+// JWT token，必须包含"exp"声明，uid取自"uid"声明，没有时取"sub"，其余声明作为附加属性
+type jwtAuthenticator struct {
+	method jwt.SigningMethod
+	key    interface{}
+}
+
+func (a *jwtAuthenticator) Authenticate(req *LoginReq) (int64, map[string]interface{}, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(req.Token, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != a.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return a.key, nil
+	})
+	if err != nil {
+		if e, ok := err.(*jwt.ValidationError); ok && e.Errors&jwt.ValidationErrorExpired != 0 {
+			return 0, nil, ErrTokenExpired
+		}
+		return 0, nil, err
+	}
+	// 没有过期时间的token永不过期，不予接受
+	if _, ok := claims["exp"]; !ok {
+		return 0, nil, ErrInvalidToken
+	}
+
+	var uid int64
+	switch v := claims["uid"].(type) {
+	case float64:
+		uid = int64(v)
+	case string:
+		uid, err = strconv.ParseInt(v, 10, 64)
+	default:
+		sub, _ := claims["sub"].(string)
+		uid, err = strconv.ParseInt(sub, 10, 64)
+	}
+	if err != nil {
+		return 0, nil, ErrInvalidToken
+	}
+	return uid, claims, nil
+}
+
+// 对称密钥文件
+func NewJwtHS256Authenticator(keyFile string) (Authenticator, error) {
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimRight(key, "\r\n")
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	return &jwtAuthenticator{
+		method: jwt.SigningMethodHS256,
+		key:    key,
+	}, nil
+}
+
+// PEM格式的RSA公钥文件
+func NewJwtRS256Authenticator(pubKeyFile string) (Authenticator, error) {
+	pem, err := ioutil.ReadFile(pubKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+	if err != nil {
+		return nil, err
+	}
+	return &jwtAuthenticator{
+		method: jwt.SigningMethodRS256,
+		key:    key,
+	}, nil
+}
@@ -4,16 +4,26 @@ import (
 	"context"
 	"fmt"
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	log "github.com/micro/go-micro/v2/logger"
+	"sync"
 	"time"
 )
 
 const (
-	RegClientKeyFmt  = "/ids/%d"
-	RegUserKeyFmt    = "/uids/%d"
-	RegChannelKeyFmt = "/chans/%s"
+	RegClientKeyPrefix  = "/ids/"
+	RegUserKeyPrefix    = "/uids/"
+	RegChannelKeyPrefix = "/chans/"
 
-	etcdClientTimeout = time.Millisecond * 200
-	refreshTtlPeriod  = time.Second * 10
+	RegClientKeyFmt  = RegClientKeyPrefix + "%d"
+	RegUserKeyFmt    = RegUserKeyPrefix + "%d"
+	RegChannelKeyFmt = RegChannelKeyPrefix + "%s"
+
+	etcdClientTimeout = time.Millisecond * 1000
+	etcdFlushPeriod   = time.Millisecond * 100
+	etcdRetryPeriod   = time.Second * 1
+	etcdMaxTxnOps     = 128 // etcd默认--max-txn-ops
+	minLeaseTtl       = time.Second * 5
 	regChanBufSize    = 1000
 )
 
@@ -23,93 +33,298 @@ type Distribute interface {
 	Run() (stopFunc func())
 }
 
-type etcd struct {
+// 注册或注销操作，经同一通道传递以保持先后顺序
+type regOp struct {
+	key string
+	add bool
+}
+
+// 对注册的key进行引用计数
+// 同一节点上多次注册同一个key(如同一用户的多个客户端)时，仅首次注册和最后一次注销会传递给底层实现
+// 持锁更新计数并按序加入队列，由单个协程在锁外传递给底层实现，调用方不会被底层实现阻塞
+type refCountDistribute struct {
+	Distribute
+
+	mu       sync.Mutex
+	refs     map[string]int
+	ops      []regOp
+	draining bool
+}
+
+func (d *refCountDistribute) Register(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := d.refs[key]
+	d.refs[key] = n + 1
+	if n == 0 {
+		d.enqueue(regOp{key: key, add: true})
+	}
+}
+
+func (d *refCountDistribute) Unregister(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n, ok := d.refs[key]
+	if !ok {
+		return
+	}
+	if n > 1 {
+		d.refs[key] = n - 1
+		return
+	}
+	delete(d.refs, key)
+	d.enqueue(regOp{key: key, add: false})
+}
+
+// 需持有d.mu
+func (d *refCountDistribute) enqueue(op regOp) {
+	d.ops = append(d.ops, op)
+	if !d.draining {
+		d.draining = true
+		go d.drain()
+	}
+}
+
+// 队列为空时退出，同一时刻至多一个协程，保证传递顺序与入队顺序一致
+func (d *refCountDistribute) drain() {
+	for {
+		d.mu.Lock()
+		if len(d.ops) == 0 {
+			d.ops = nil
+			d.draining = false
+			d.mu.Unlock()
+			return
+		}
+		op := d.ops[0]
+		d.ops = d.ops[1:]
+		d.mu.Unlock()
+
+		if op.add {
+			d.Distribute.Register(op.key)
+		} else {
+			d.Distribute.Unregister(op.key)
+		}
+	}
+}
+
+func NewRefCountDistribute(distribute Distribute) Distribute {
+	if _, ok := distribute.(*refCountDistribute); ok {
+		return distribute
+	}
+	d := &refCountDistribute{
+		Distribute: distribute,
+		refs:       make(map[string]int),
+	}
+	return d
+}
+
+// 节点持有一个共享租约，所有注册的key都挂在该租约上
+// 注册/注销先合并为待提交操作，周期性地以事务批量提交
+// 租约失效(如etcd故障恢复后)时重新申请租约并重新注册全部key
+type etcdDistribute struct {
 	nodeName string
-	store    *clientv3.Client
+	store    EtcdStore
 	ttl      time.Duration
 
-	regCh   chan string
-	unregCh chan string
+	opCh   chan regOp
+	doneCh chan struct{} // 停止后不再阻塞注册/注销
+}
+
+func (d *etcdDistribute) send(op regOp) {
+	select {
+	case d.opCh <- op:
+	case <-d.doneCh:
+	}
 }
 
-func (d *etcd) Register(key string) {
-	d.regCh <- key
+func (d *etcdDistribute) Register(key string) {
+	d.send(regOp{key: key, add: true})
 }
 
-func (d *etcd) Unregister(key string) {
-	d.unregCh <- key
+func (d *etcdDistribute) Unregister(key string) {
+	d.send(regOp{key: key, add: false})
 }
 
-func (d *etcd) Run() (stopFunc func()) {
+func (d *etcdDistribute) Run() (stopFunc func()) {
 	stopCh := make(chan struct{})
 
 	stopFunc = func() {
 		close(stopCh)
+		<-d.doneCh
 	}
 
 	go func() {
-		ttl := int64(d.ttl / time.Second)
-		registry := make(map[string]clientv3.LeaseID)
+		defer close(d.doneCh)
+		d.loop(stopCh)
+	}()
+	return stopFunc
+}
 
-		t := time.NewTicker(refreshTtlPeriod)
+// 更新本节点已注册的key及待提交操作，pending中true为注册，false为注销
+func applyRegOp(registry map[string]struct{}, pending map[string]bool, op regOp) {
+	if op.add {
+		registry[op.key] = struct{}{}
+		pending[op.key] = true
+		return
+	}
+	if _, ok := registry[op.key]; !ok {
+		return
+	}
+	delete(registry, op.key)
+	pending[op.key] = false
+}
 
-		for {
-			select {
-			case <-stopCh:
-				return
+func (d *etcdDistribute) nodeKey(key string) string {
+	return fmt.Sprintf("%s/%s", key, d.nodeName)
+}
 
-			case key := <-d.regCh:
-				ctx, _ := context.WithTimeout(context.Background(), etcdClientTimeout)
-				leaseRsp, err := d.store.Grant(ctx, ttl)
-				if err != nil {
-					break
-				}
-				registry[key] = leaseRsp.ID
+func (d *etcdDistribute) loop(stopCh chan struct{}) {
+	registry := make(map[string]struct{})
+	pending := make(map[string]bool) // key -> true:put, false:delete
 
-				ctx, _ = context.WithTimeout(context.Background(), etcdClientTimeout)
-				k := fmt.Sprintf("%s/%s", key, d.nodeName)
-				_, err = d.store.Put(ctx, k, d.nodeName, clientv3.WithLease(leaseRsp.ID))
-				if err != nil {
-					break
-				}
+	var leaseID clientv3.LeaseID
+	var keepAlive <-chan *clientv3.LeaseKeepAliveResponse
+	var keepAliveCancel context.CancelFunc
+	var lastGrant time.Time
 
-			case key := <-d.unregCh:
-				leaseID, ok := registry[key]
-				if !ok {
-					break
+	releaseLease := func() {
+		if keepAliveCancel != nil {
+			keepAliveCancel()
+			keepAliveCancel = nil
+		}
+		keepAlive = nil
+		leaseID = clientv3.NoLease
+	}
+
+	grant := func() {
+		lastGrant = time.Now()
+
+		ctx, cancel := context.WithTimeout(context.Background(), etcdClientTimeout)
+		leaseRsp, err := d.store.Grant(ctx, int64(d.ttl/time.Second))
+		cancel()
+		if err != nil {
+			log.Errorf("etcd distribute grant lease err, %v", err)
+			return
+		}
+
+		ctx, keepAliveCancel = context.WithCancel(context.Background())
+		keepAlive, err = d.store.KeepAlive(ctx, leaseRsp.ID)
+		if err != nil {
+			log.Errorf("etcd distribute keep lease alive err, %v", err)
+			releaseLease()
+			return
+		}
+		leaseID = leaseRsp.ID
+		log.Infof("etcd distribute granted lease %x", leaseID)
+
+		// 新租约上没有任何key，重新注册全部key
+		pending = make(map[string]bool, len(registry))
+		for key := range registry {
+			pending[key] = true
+		}
+	}
+
+	flush := func() {
+		ops := make([]clientv3.Op, 0, etcdMaxTxnOps)
+		keys := make([]string, 0, etcdMaxTxnOps)
+		commit := func() bool {
+			ctx, cancel := context.WithTimeout(context.Background(), etcdClientTimeout)
+			_, err := d.store.Txn(ctx).Then(ops...).Commit()
+			cancel()
+			if err != nil {
+				log.Errorf("etcd distribute commit %d ops err, %v", len(ops), err)
+				if err == rpctypes.ErrLeaseNotFound {
+					releaseLease()
 				}
-				delete(registry, key)
+				return false
+			}
+			for _, key := range keys {
+				delete(pending, key)
+			}
+			ops, keys = ops[:0], keys[:0]
+			return true
+		}
 
-				ctx, _ := context.WithTimeout(context.Background(), etcdClientTimeout)
+		for key, put := range pending {
+			if put {
+				ops = append(ops, clientv3.OpPut(d.nodeKey(key), d.nodeName, clientv3.WithLease(leaseID)))
+			} else {
+				ops = append(ops, clientv3.OpDelete(d.nodeKey(key)))
+			}
+			keys = append(keys, key)
+			if len(ops) == etcdMaxTxnOps && !commit() {
+				return
+			}
+		}
+		if len(ops) > 0 {
+			commit()
+		}
+	}
+
+	t := time.NewTicker(etcdFlushPeriod)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			if leaseID != clientv3.NoLease {
+				// 撤销租约，所有key立即失效
+				ctx, cancel := context.WithTimeout(context.Background(), etcdClientTimeout)
 				_, err := d.store.Revoke(ctx, leaseID)
+				cancel()
 				if err != nil {
-					break
+					log.Errorf("etcd distribute revoke lease err, %v", err)
 				}
+			}
+			releaseLease()
+			return
+
+		case op := <-d.opCh:
+			applyRegOp(registry, pending, op)
+
+		case _, ok := <-keepAlive:
+			if !ok {
+				// 租约已过期或keepalive中断，挂在其上的key已经或即将失效
+				log.Errorf("etcd distribute lease %x lost", leaseID)
+				releaseLease()
+			}
 
-			case <-t.C:
-				for _, leaseID := range registry {
-					ctx, _ := context.WithTimeout(context.Background(), etcdClientTimeout)
-					_, err := d.store.KeepAliveOnce(ctx, leaseID)
-					if err != nil {
-					}
+		case <-t.C:
+			if leaseID == clientv3.NoLease {
+				if time.Since(lastGrant) < etcdRetryPeriod {
+					break
 				}
+				grant()
+				if leaseID == clientv3.NoLease {
+					break
+				}
+			}
+			if len(pending) > 0 {
+				flush()
 			}
 		}
-	}()
-	return stopFunc
+	}
+}
+
+// etcd注册存储，通常为*clientv3.Client
+type EtcdStore interface {
+	clientv3.KV
+	clientv3.Lease
 }
 
-func NewEtcdDistribute(nodeName string, store *clientv3.Client, ttl time.Duration) Distribute {
-	if ttl <= refreshTtlPeriod {
+func NewEtcdDistribute(nodeName string, store EtcdStore, ttl time.Duration) Distribute {
+	if ttl < minLeaseTtl {
 		panic("ttl is too small")
 	}
-	d := &etcd{
+	d := &etcdDistribute{
 		nodeName: nodeName,
 		store:    store,
 		ttl:      ttl,
 
-		regCh:   make(chan string, regChanBufSize),
-		unregCh: make(chan string, regChanBufSize),
+		opCh:   make(chan regOp, regChanBufSize),
+		doneCh: make(chan struct{}),
 	}
 	return d
 }
@@ -0,0 +1,110 @@
+package tchatroom
+
+import (
+	"fmt"
+	"sync"
+)
+
+// 进程内的注册存储，可被多个节点共享，用于测试或单进程集群
+type MemoryStore struct {
+	mu   sync.RWMutex
+	keys map[string]map[string]struct{} // key -> node set
+}
+
+func (s *MemoryStore) add(key, node string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nodes, ok := s.keys[key]
+	if !ok {
+		nodes = make(map[string]struct{})
+		s.keys[key] = nodes
+	}
+	nodes[node] = struct{}{}
+}
+
+func (s *MemoryStore) remove(key, node string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nodes, ok := s.keys[key]
+	if !ok {
+		return
+	}
+	delete(nodes, node)
+	if len(nodes) == 0 {
+		delete(s.keys, key)
+	}
+}
+
+// 与GetDistributeNodes返回格式一致，node -> "key/node"
+func (s *MemoryStore) Nodes(keys []string) map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ret := make(map[string]string)
+	for _, key := range keys {
+		for node := range s.keys[key] {
+			ret[node] = fmt.Sprintf("%s/%s", key, node)
+		}
+	}
+	return ret
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		keys: make(map[string]map[string]struct{}),
+	}
+	return s
+}
+
+// 同步写入MemoryStore
+// 直接调用时注册/注销返回即可被查询到；经Room使用时会包装为refCountDistribute异步传递，需等待其生效
+type memoryDistribute struct {
+	nodeName string
+	store    *MemoryStore
+
+	mu       sync.Mutex
+	registry map[string]struct{}
+}
+
+func (d *memoryDistribute) Register(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.registry[key] = struct{}{}
+	d.store.add(key, d.nodeName)
+}
+
+func (d *memoryDistribute) Unregister(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.registry[key]; !ok {
+		return
+	}
+	delete(d.registry, key)
+	d.store.remove(key, d.nodeName)
+}
+
+func (d *memoryDistribute) Run() (stopFunc func()) {
+	stopFunc = func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		for key := range d.registry {
+			d.store.remove(key, d.nodeName)
+		}
+		d.registry = make(map[string]struct{})
+	}
+	return stopFunc
+}
+
+func NewMemoryDistribute(nodeName string, store *MemoryStore) Distribute {
+	d := &memoryDistribute{
+		nodeName: nodeName,
+		store:    store,
+		registry: make(map[string]struct{}),
+	}
+	return d
+}
@@ -0,0 +1,238 @@
+package tchatroom
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	log "github.com/micro/go-micro/v2/logger"
+	"time"
+)
+
+const (
+	RegNodeKeyFmt      = "/nodes/%s"      // 节点心跳
+	RegNodeSetKey      = "/nodes"         // 注册过key的全部节点
+	RegNodeIndexKeyFmt = "/nodes/%s/keys" // 节点注册的全部key，用于清理已失效节点
+
+	redisClientTimeout = time.Millisecond * 1000
+	redisFlushPeriod   = time.Millisecond * 100
+	redisMaxPipeCmds   = 512
+)
+
+// 每个注册key对应一个集合，成员为注册了该key的节点名
+// 节点以带过期时间的心跳key表示存活，查询时过滤掉心跳已过期的节点
+// 心跳key过期(如redis故障恢复后)时重新注册全部key
+// 各节点在心跳时清理心跳已过期节点在各集合中的成员
+type redisDistribute struct {
+	nodeName string
+	store    *redis.Client
+	ttl      time.Duration
+
+	opCh   chan regOp
+	doneCh chan struct{}
+}
+
+// 心跳不存在时从其注册的全部集合中移除该节点
+// KEYS: 节点集合、心跳key、索引key，ARGV: 节点名
+var sweepNodeScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	return 0
+end
+local keys = redis.call("SMEMBERS", KEYS[3])
+for _, key in ipairs(keys) do
+	redis.call("SREM", key, ARGV[1])
+end
+redis.call("DEL", KEYS[3])
+redis.call("SREM", KEYS[1], ARGV[1])
+return #keys
+`)
+
+func (d *redisDistribute) send(op regOp) {
+	select {
+	case d.opCh <- op:
+	case <-d.doneCh:
+	}
+}
+
+func (d *redisDistribute) Register(key string) {
+	d.send(regOp{key: key, add: true})
+}
+
+func (d *redisDistribute) Unregister(key string) {
+	d.send(regOp{key: key, add: false})
+}
+
+func (d *redisDistribute) Run() (stopFunc func()) {
+	stopCh := make(chan struct{})
+
+	stopFunc = func() {
+		close(stopCh)
+		<-d.doneCh
+	}
+
+	go func() {
+		defer close(d.doneCh)
+		d.loop(stopCh)
+	}()
+	return stopFunc
+}
+
+func (d *redisDistribute) client() (*redis.Client, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisClientTimeout)
+	return d.store.WithContext(ctx), cancel
+}
+
+func (d *redisDistribute) loop(stopCh chan struct{}) {
+	registry := make(map[string]struct{})
+	pending := make(map[string]bool) // key -> true:sadd, false:srem
+	nodeKey := fmt.Sprintf(RegNodeKeyFmt, d.nodeName)
+	indexKey := fmt.Sprintf(RegNodeIndexKeyFmt, d.nodeName)
+
+	heartbeat := func() {
+		cli, cancel := d.client()
+		defer cancel()
+
+		created, err := cli.SetNX(nodeKey, d.nodeName, d.ttl).Result()
+		if err != nil {
+			log.Errorf("redis distribute heartbeat err, %v", err)
+			return
+		}
+		if !created {
+			if err := cli.Expire(nodeKey, d.ttl).Err(); err != nil {
+				log.Errorf("redis distribute heartbeat err, %v", err)
+			}
+			return
+		}
+
+		if err := cli.SAdd(RegNodeSetKey, d.nodeName).Err(); err != nil {
+			log.Errorf("redis distribute add node err, %v", err)
+		}
+
+		// 心跳key是新建的，之前的注册可能已经丢失，重新注册全部key
+		log.Infof("redis distribute node %s is alive", d.nodeName)
+		pending = make(map[string]bool, len(registry))
+		for key := range registry {
+			pending[key] = true
+		}
+	}
+
+	sweep := func() {
+		cli, cancel := d.client()
+		defer cancel()
+
+		nodes, err := cli.SMembers(RegNodeSetKey).Result()
+		if err != nil {
+			log.Errorf("redis distribute list nodes err, %v", err)
+			return
+		}
+		for _, node := range nodes {
+			if node == d.nodeName {
+				continue
+			}
+			keys := []string{RegNodeSetKey, fmt.Sprintf(RegNodeKeyFmt, node), fmt.Sprintf(RegNodeIndexKeyFmt, node)}
+			n, err := sweepNodeScript.Run(cli, keys, node).Int()
+			if err != nil {
+				log.Errorf("redis distribute sweep node %s err, %v", node, err)
+				continue
+			}
+			if n > 0 {
+				log.Infof("redis distribute swept %d keys of dead node %s", n, node)
+			}
+		}
+	}
+
+	flush := func() {
+		keys := make([]string, 0, redisMaxPipeCmds)
+		commit := func() bool {
+			cli, cancel := d.client()
+			defer cancel()
+
+			_, err := cli.Pipelined(func(pipe redis.Pipeliner) error {
+				for _, key := range keys {
+					if pending[key] {
+						pipe.SAdd(key, d.nodeName)
+						pipe.SAdd(indexKey, key)
+					} else {
+						pipe.SRem(key, d.nodeName)
+						pipe.SRem(indexKey, key)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				log.Errorf("redis distribute commit %d cmds err, %v", len(keys), err)
+				return false
+			}
+			for _, key := range keys {
+				delete(pending, key)
+			}
+			keys = keys[:0]
+			return true
+		}
+
+		for key := range pending {
+			keys = append(keys, key)
+			if len(keys) == redisMaxPipeCmds && !commit() {
+				return
+			}
+		}
+		if len(keys) > 0 {
+			commit()
+		}
+	}
+
+	heartbeat()
+
+	ft := time.NewTicker(redisFlushPeriod)
+	defer ft.Stop()
+	ht := time.NewTicker(d.ttl / 3)
+	defer ht.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			// 注销全部key并删除心跳
+			pending = make(map[string]bool, len(registry))
+			for key := range registry {
+				pending[key] = false
+			}
+			flush()
+
+			cli, cancel := d.client()
+			if err := cli.Del(nodeKey, indexKey).Err(); err != nil {
+				log.Errorf("redis distribute delete heartbeat err, %v", err)
+			}
+			if err := cli.SRem(RegNodeSetKey, d.nodeName).Err(); err != nil {
+				log.Errorf("redis distribute remove node err, %v", err)
+			}
+			cancel()
+			return
+
+		case op := <-d.opCh:
+			applyRegOp(registry, pending, op)
+
+		case <-ht.C:
+			heartbeat()
+			sweep()
+
+		case <-ft.C:
+			if len(pending) > 0 {
+				flush()
+			}
+		}
+	}
+}
+
+func NewRedisDistribute(nodeName string, store *redis.Client, ttl time.Duration) Distribute {
+	if ttl < minLeaseTtl {
+		panic("ttl is too small")
+	}
+	d := &redisDistribute{
+		nodeName: nodeName,
+		store:    store,
+		ttl:      ttl,
+
+		opCh:   make(chan regOp, regChanBufSize),
+		doneCh: make(chan struct{}),
+	}
+	return d
+}
@@ -1,35 +1,99 @@
 package tchatroom
 
 import (
+	"context"
 	"errors"
 	log "github.com/micro/go-micro/v2/logger"
 	"net/http"
+	"strings"
 	"time"
 	"tpush/internal/twebsocket"
 )
 
 type handler struct {
-	room *Room
+	room        *Room
+	auth        Authenticator
+	upgradeAuth bool
 }
 
 type loginDoneKey struct{}
 
+type preLoginKey struct{}
+
+type preLogin struct {
+	uid   int64
+	attrs map[string]interface{}
+}
+
 type clientDataKey struct{}
 
 type clientData struct {
-	id int64
+	id    int64
+	attrs map[string]interface{}
 }
 
-func (h *handler) OpUpgrade(req *http.Request) error {
+// 登录认证返回的附加属性
+func ClientAttrs(cli twebsocket.Client) map[string]interface{} {
+	if data, ok := cli.ContextValue(clientDataKey{}).(*clientData); ok {
+		return data.attrs
+	}
 	return nil
 }
 
+// 依次从Authorization头、cookie、查询参数中获取token
+func upgradeToken(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if cookie, err := req.Cookie(TokenCookieName); err == nil {
+		return cookie.Value
+	}
+	if token := req.URL.Query().Get(TokenQueryKey); len(token) != 0 {
+		return token
+	}
+	return ""
+}
+
+// 升级时认证通过的客户端直接登录，无需再发送login命令
+func (h *handler) OpUpgrade(req *http.Request) (context.Context, error) {
+	if h.auth == nil {
+		return nil, nil
+	}
+
+	token := upgradeToken(req)
+	if len(token) == 0 {
+		if h.upgradeAuth {
+			return nil, twebsocket.NewStatusError(http.StatusUnauthorized, ErrInvalidToken)
+		}
+		return nil, nil
+	}
+
+	uid, attrs, err := h.auth.Authenticate(&LoginReq{Token: token})
+	if err != nil {
+		if _, ok := err.(*twebsocket.StatusError); ok {
+			return nil, err
+		}
+		return nil, twebsocket.NewStatusError(http.StatusUnauthorized, err)
+	}
+	return context.WithValue(context.Background(), preLoginKey{}, &preLogin{uid: uid, attrs: attrs}), nil
+}
+
 func (h *handler) OnOpen(cli twebsocket.Client) error {
+	clientData := &clientData{
+		id: h.room.AddClient(cli),
+	}
+	cli.AddContextValue(clientDataKey{}, clientData)
+
+	if pre, ok := cli.ContextValue(preLoginKey{}).(*preLogin); ok {
+		clientData.attrs = pre.attrs
+		h.room.Login(cli, pre.uid)
+		log.Debugf("client logged in on upgrade succ, uid: %v", pre.uid)
+		cli.Write(CmdLogin, 0, newLoginRsp(cli, clientData.id), 0, "", twebsocket.WithPriority(twebsocket.PriorityHigh))
+		return nil
+	}
+
 	loginDone := make(chan int64)
 	cli.AddContextValue(loginDoneKey{}, loginDone)
-	cli.AddContextValue(clientDataKey{}, &clientData{
-		id: h.room.AddClient(cli),
-	})
 
 	go func() {
 		defer log.Debug("waitLogin complete")
@@ -51,176 +115,154 @@ func (h *handler) OnClose(cli twebsocket.Client) {
 	h.room.RemoveClient(cli)
 }
 
-func (h *handler) Ping(req twebsocket.Request, rsp twebsocket.Response) error {
-	return nil
+func (h *handler) Ping(ctx context.Context, cli twebsocket.Client, req *PingReq) (*PingRsp, error) {
+	return nil, nil
 }
 
-func (h *handler) Login(req twebsocket.Request, rsp twebsocket.Response) error {
-	var request LoginReq
-	if err := req.DecodeData(&request); err != nil {
-		return err
+// 客户端只能延长合批窗口(不超过MaxFlushInterval)或减小最大批量
+func negotiateBatching(cli twebsocket.Client, req *LoginReq) {
+	interval, maxBatch := cli.Batching()
+	if d := time.Duration(req.FlushInterval) * time.Millisecond; d > interval {
+		if d > MaxFlushInterval {
+			d = MaxFlushInterval
+		}
+		if d > interval {
+			interval = d
+		}
+	}
+	if req.MaxBatch > 0 && (maxBatch == 0 || req.MaxBatch < maxBatch) {
+		maxBatch = req.MaxBatch
 	}
-	uid := request.Uid
+	cli.SetBatching(interval, maxBatch)
+}
 
-	loginDone := req.Client().ContextValue(loginDoneKey{}).(chan int64)
-	loginDone <- uid
+func newLoginRsp(cli twebsocket.Client, id int64) *LoginRsp {
+	interval, maxBatch := cli.Batching()
+	return &LoginRsp{
+		Id:            id,
+		FlushInterval: int64(interval / time.Millisecond),
+		MaxBatch:      maxBatch,
+	}
+}
 
-	clientData := req.Client().ContextValue(clientDataKey{}).(*clientData)
+func (h *handler) Login(ctx context.Context, cli twebsocket.Client, req *LoginReq) (*LoginRsp, error) {
+	uid := req.Uid
 
-	rsp.EncodeData(&LoginRsp{
-		Id: clientData.id,
-	}, 0, "")
+	clientData := cli.ContextValue(clientDataKey{}).(*clientData)
 
-	return nil
-}
+	if _, ok := cli.ContextValue(preLoginKey{}).(*preLogin); ok {
+		// 升级时已登录
+		negotiateBatching(cli, req)
+		return newLoginRsp(cli, clientData.id), nil
+	}
 
-func (h *handler) EnterChan(req twebsocket.Request, rsp twebsocket.Response) error {
-	var request EnterChanReq
-	if err := req.DecodeData(&request); err != nil {
-		return err
+	if h.auth != nil {
+		var err error
+		uid, clientData.attrs, err = h.auth.Authenticate(req)
+		if err != nil {
+			log.Errorf("client login failed, uid: %v, %v", req.Uid, err)
+			return nil, twebsocket.NewCodeError(ErrLoginFailed, "login failed", true)
+		}
 	}
 
-	h.room.ClientEnterChannel(req.Client(), request.Chans...)
+	negotiateBatching(cli, req)
 
-	rsp.EncodeData(&EnterChanRsp{}, 0, "")
+	loginDone := cli.ContextValue(loginDoneKey{}).(chan int64)
+	loginDone <- uid
 
-	return nil
+	return newLoginRsp(cli, clientData.id), nil
 }
 
-func (h *handler) ExitChan(req twebsocket.Request, rsp twebsocket.Response) error {
-	var request ExitChanReq
-	if err := req.DecodeData(&request); err != nil {
-		return err
-	}
-
-	h.room.ClientExitChannel(req.Client(), request.Chans...)
-
-	rsp.EncodeData(&ExitChanRsp{}, 0, "")
+func (h *handler) EnterChan(ctx context.Context, cli twebsocket.Client, req *EnterChanReq) (*EnterChanRsp, error) {
+	h.room.ClientEnterChannel(cli, req.Chans...)
+	return &EnterChanRsp{}, nil
+}
 
-	return nil
+func (h *handler) ExitChan(ctx context.Context, cli twebsocket.Client, req *ExitChanReq) (*ExitChanRsp, error) {
+	h.room.ClientExitChannel(cli, req.Chans...)
+	return &ExitChanRsp{}, nil
 }
 
-func (h *handler) SendToClient(req twebsocket.Request, rsp twebsocket.Response) error {
-	var request SendToClientReq
-	if err := req.DecodeData(&request); err != nil {
-		return err
+// 发送方的登录信息
+func (h *handler) sender(cli twebsocket.Client) (id, uid int64, err error) {
+	uid, ok := h.room.User(cli)
+	if !ok {
+		return 0, 0, twebsocket.NewCodeError(ErrNotLogin, "client hasnot logged in", true)
 	}
 
-	uid, ok := h.room.User(req.Client())
+	id, ok = h.room.ClientId(cli)
 	if !ok {
-		return twebsocket.Error(rsp, ErrNotLogin, "client hasnot logged in", true)
+		return 0, 0, errors.New("client has no id")
 	}
+	return id, uid, nil
+}
 
-	id, ok := h.room.ClientId(req.Client())
-	if !ok {
-		return twebsocket.Fatal(rsp, errors.New("client has no id"))
+func (h *handler) SendToClient(ctx context.Context, cli twebsocket.Client, req *SendToClientReq) (*SendToClientRsp, error) {
+	id, uid, err := h.sender(cli)
+	if err != nil {
+		return nil, err
 	}
 
 	data := &RecvDataRsp{
 		Id:   id,
 		Uid:  uid,
 		Chan: "",
-		Data: twebsocket.EncodeData(request.Data),
+		Data: twebsocket.EncodeData(req.Data),
+		Key:  req.Key,
 	}
 
-	if len(request.Ids) == 1 {
-		cli, ok := h.room.Client(request.Ids[0])
-		if !ok {
-			return twebsocket.Error(rsp, ErrClientNotFound, "dest client not found", false)
-		}
-		go cli.Write(CmdRecvData, 0, data, 0, "", false)
-	} else {
-		cligrp := h.room.Clients(request.Ids)
-		go cligrp.Write(CmdRecvData, 0, data, 0, "", false)
+	ds := h.room.SendToClients(req.Ids, data, false)
+	if len(ds) == 1 && ds[0].Matched == 0 {
+		return nil, twebsocket.NewCodeError(ErrClientNotFound, "dest client not found", false)
 	}
-
-	rsp.EncodeData(&SendToClientRsp{}, 0, "")
-	return nil
+	return &SendToClientRsp{}, nil
 }
 
-func (h *handler) SendToUser(req twebsocket.Request, rsp twebsocket.Response) error {
-	var request SendToUserReq
-	if err := req.DecodeData(&request); err != nil {
-		return err
-	}
-
-	uid, ok := h.room.User(req.Client())
-	if !ok {
-		return twebsocket.Error(rsp, ErrNotLogin, "client hasnot logged in", true)
-	}
-
-	id, ok := h.room.ClientId(req.Client())
-	if !ok {
-		return twebsocket.Fatal(rsp, errors.New("client has no id"))
+func (h *handler) SendToUser(ctx context.Context, cli twebsocket.Client, req *SendToUserReq) (*SendToUserRsp, error) {
+	id, uid, err := h.sender(cli)
+	if err != nil {
+		return nil, err
 	}
 
 	data := &RecvDataRsp{
 		Id:   id,
 		Uid:  uid,
 		Chan: "",
-		Data: twebsocket.EncodeData(request.Data),
+		Data: twebsocket.EncodeData(req.Data),
+		Key:  req.Key,
 	}
 
-	if len(request.Uids) == 1 {
-		cligrp, ok := h.room.ClientsOfUser(request.Uids[0])
-		if !ok {
-			return twebsocket.Error(rsp, ErrUserNotFound, "dest user not found", false)
-		}
-		go cligrp.Write(CmdRecvData, 0, data, 0, "", false)
-	} else {
-		cligrp := h.room.ClientsOfUsers(request.Uids)
-		go cligrp.Write(CmdRecvData, 0, data, 0, "", false)
+	ds := h.room.SendToUsers(req.Uids, data, false)
+	if len(ds) == 1 && ds[0].Matched == 0 {
+		return nil, twebsocket.NewCodeError(ErrUserNotFound, "dest user not found", false)
 	}
-
-	rsp.EncodeData(&SendToUserRsp{}, 0, "")
-	return nil
+	return &SendToUserRsp{}, nil
 }
 
-func (h *handler) SendToChan(req twebsocket.Request, rsp twebsocket.Response) error {
-	var request SendToChanReq
-	if err := req.DecodeData(&request); err != nil {
-		return err
-	}
-
-	uid, ok := h.room.User(req.Client())
-	if !ok {
-		return twebsocket.Error(rsp, ErrNotLogin, "client hasnot logged in", true)
-	}
-
-	id, ok := h.room.ClientId(req.Client())
-	if !ok {
-		return twebsocket.Fatal(rsp, errors.New("client has no id"))
+func (h *handler) SendToChan(ctx context.Context, cli twebsocket.Client, req *SendToChanReq) (*SendToChanRsp, error) {
+	id, uid, err := h.sender(cli)
+	if err != nil {
+		return nil, err
 	}
 
 	data := &RecvDataRsp{
 		Id:   id,
 		Uid:  uid,
-		Data: twebsocket.EncodeData(request.Data),
+		Data: twebsocket.EncodeData(req.Data),
+		Key:  req.Key,
 	}
 
-	if len(request.Chans) == 1 {
-		cligrp, ok := h.room.ClientsInChannel(request.Chans[0])
-		if !ok {
-			return twebsocket.Error(rsp, ErrChanNotFound, "dest chan not found", false)
-		}
-		data.Chan = request.Chans[0]
-		go cligrp.Write(CmdRecvData, 0, data, 0, "", false)
-	} else {
-		go func() {
-			for _, ch := range request.Chans {
-				cligrp, ok := h.room.ClientsInChannel(ch)
-				if ok {
-					data.Chan = ch
-					cligrp.Write(CmdRecvData, 0, data, 0, "", false)
-				}
-			}
-		}()
-	}
-
-	rsp.EncodeData(&SendToChanRsp{}, 0, "")
-	return nil
+	ds := h.room.SendToChannels(req.Chans, data, false)
+	if len(ds) == 1 && ds[0].Matched == 0 {
+		return nil, twebsocket.NewCodeError(ErrChanNotFound, "dest chan not found", false)
+	}
+	return &SendToChanRsp{}, nil
 }
 
 func (h *handler) RecvData(req twebsocket.Request, rsp twebsocket.Response) error {
 	return twebsocket.Error(rsp, ErrWrongCmd, "wrong cmd", false)
 }
+
+func (h *handler) Notice(req twebsocket.Request, rsp twebsocket.Response) error {
+	return twebsocket.Error(rsp, ErrWrongCmd, "wrong cmd", false)
+}
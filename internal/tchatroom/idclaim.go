@@ -0,0 +1,249 @@
+package tchatroom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/go-redis/redis/v7"
+	log "github.com/micro/go-micro/v2/logger"
+	"hash/fnv"
+	"time"
+)
+
+const (
+	RegSnowflakeKeyFmt = "/snowflake/%d" // snowflake节点号的占用者
+)
+
+var (
+	ErrNodeIdTaken = errors.New("snowflake node id is taken by another node")
+)
+
+// 在分布式存储中占用snowflake节点号，保证集群内唯一
+type NodeIdClaimer interface {
+	// 占用节点号，已被其他节点占用时返回ErrNodeIdTaken
+	Claim(node int64) error
+	// 周期性续期已占用的节点号，丢失后重新占用，停止时释放
+	Run() (stopFunc func())
+}
+
+// 由服务节点标识(如go-micro server id)计算snowflake节点号
+func SnowflakeNode(serverId string) int64 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(serverId))
+	return int64(h.Sum32() % (SnowflakeMaxNode + 1))
+}
+
+// 占用节点号并返回实际占用的节点号
+// strict为false时若node已被占用则依次尝试后续节点号
+func ClaimSnowflakeNode(c NodeIdClaimer, node int64, strict bool) (int64, error) {
+	for i := int64(0); i <= SnowflakeMaxNode; i++ {
+		n := (node + i) & SnowflakeMaxNode
+		err := c.Claim(n)
+		if err == nil {
+			return n, nil
+		}
+		if err != ErrNodeIdTaken || strict {
+			return -1, fmt.Errorf("claim snowflake node id %d err, %v", n, err)
+		}
+	}
+	return -1, ErrNodeIdTaken
+}
+
+// 续期失败仅记录日志，被其他节点占用说明发生了冲突
+func runNodeIdClaimer(node func() int64, refresh func() error, release func(), period time.Duration) (stopFunc func()) {
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+
+	stopFunc = func() {
+		close(stopCh)
+		<-doneCh
+	}
+
+	go func() {
+		defer close(doneCh)
+
+		t := time.NewTicker(period)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-stopCh:
+				release()
+				return
+			case <-t.C:
+				if err := refresh(); err == ErrNodeIdTaken {
+					log.Errorf("snowflake node id %d collides with another node", node())
+				} else if err != nil {
+					log.Errorf("snowflake node id %d refresh err, %v", node(), err)
+				}
+			}
+		}
+	}()
+	return stopFunc
+}
+
+// 以挂在独立租约上的key占用节点号
+type etcdNodeIdClaimer struct {
+	nodeName string
+	store    EtcdStore
+	ttl      time.Duration
+
+	node    int64
+	leaseID clientv3.LeaseID
+}
+
+func (c *etcdNodeIdClaimer) revoke(id clientv3.LeaseID) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdClientTimeout)
+	defer cancel()
+	if _, err := c.store.Revoke(ctx, id); err != nil {
+		log.Errorf("snowflake node id revoke lease err, %v", err)
+	}
+}
+
+func (c *etcdNodeIdClaimer) Claim(node int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdClientTimeout)
+	defer cancel()
+
+	leaseRsp, err := c.store.Grant(ctx, int64(c.ttl/time.Second))
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf(RegSnowflakeKeyFmt, node)
+	txnRsp, err := c.store.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, c.nodeName, clientv3.WithLease(leaseRsp.ID))).
+		Commit()
+	if err != nil || !txnRsp.Succeeded {
+		c.revoke(leaseRsp.ID)
+		if err != nil {
+			return err
+		}
+		return ErrNodeIdTaken
+	}
+	c.node, c.leaseID = node, leaseRsp.ID
+	return nil
+}
+
+func (c *etcdNodeIdClaimer) refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdClientTimeout)
+	_, err := c.store.KeepAliveOnce(ctx, c.leaseID)
+	cancel()
+	if err == rpctypes.ErrLeaseNotFound {
+		// 租约已过期，节点号可能已被其他节点占用
+		return c.Claim(c.node)
+	}
+	return err
+}
+
+func (c *etcdNodeIdClaimer) Run() (stopFunc func()) {
+	return runNodeIdClaimer(func() int64 { return c.node }, c.refresh, func() { c.revoke(c.leaseID) }, c.ttl/3)
+}
+
+func NewEtcdNodeIdClaimer(nodeName string, store EtcdStore, ttl time.Duration) NodeIdClaimer {
+	if ttl < minLeaseTtl {
+		panic("ttl is too small")
+	}
+	c := &etcdNodeIdClaimer{
+		nodeName: nodeName,
+		store:    store,
+		ttl:      ttl,
+		node:     -1,
+	}
+	return c
+}
+
+// 续期本节点占用的key，key已过期时重新占用
+// KEYS: 占用key，ARGV: 节点名、过期毫秒数
+var refreshNodeIdScript = redis.NewScript(`
+local owner = redis.call("GET", KEYS[1])
+if owner == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if owner then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+// 仅删除本节点占用的key
+// KEYS: 占用key，ARGV: 节点名
+var releaseNodeIdScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// 以带过期时间的key占用节点号
+type redisNodeIdClaimer struct {
+	nodeName string
+	store    *redis.Client
+	ttl      time.Duration
+
+	node int64
+}
+
+func (c *redisNodeIdClaimer) client() (*redis.Client, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisClientTimeout)
+	return c.store.WithContext(ctx), cancel
+}
+
+func (c *redisNodeIdClaimer) Claim(node int64) error {
+	cli, cancel := c.client()
+	defer cancel()
+
+	ok, err := cli.SetNX(fmt.Sprintf(RegSnowflakeKeyFmt, node), c.nodeName, c.ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNodeIdTaken
+	}
+	c.node = node
+	return nil
+}
+
+func (c *redisNodeIdClaimer) refresh() error {
+	cli, cancel := c.client()
+	defer cancel()
+
+	key := fmt.Sprintf(RegSnowflakeKeyFmt, c.node)
+	n, err := refreshNodeIdScript.Run(cli, []string{key}, c.nodeName, int64(c.ttl/time.Millisecond)).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNodeIdTaken
+	}
+	return nil
+}
+
+func (c *redisNodeIdClaimer) release() {
+	cli, cancel := c.client()
+	defer cancel()
+
+	key := fmt.Sprintf(RegSnowflakeKeyFmt, c.node)
+	if err := releaseNodeIdScript.Run(cli, []string{key}, c.nodeName).Err(); err != nil {
+		log.Errorf("snowflake node id %d release err, %v", c.node, err)
+	}
+}
+
+func (c *redisNodeIdClaimer) Run() (stopFunc func()) {
+	return runNodeIdClaimer(func() int64 { return c.node }, c.refresh, c.release, c.ttl/3)
+}
+
+func NewRedisNodeIdClaimer(nodeName string, store *redis.Client, ttl time.Duration) NodeIdClaimer {
+	if ttl < minLeaseTtl {
+		panic("ttl is too small")
+	}
+	c := &redisNodeIdClaimer{
+		nodeName: nodeName,
+		store:    store,
+		ttl:      ttl,
+		node:     -1,
+	}
+	return c
+}
@@ -0,0 +1,95 @@
+package tchatroom
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 客户端标识生成器
+type IdGenerator interface {
+	Next() int64
+}
+
+// 单机计数器，从1开始递增，仅保证进程内唯一
+type counterIdGenerator struct {
+	id int64
+}
+
+func (g *counterIdGenerator) Next() int64 {
+	id := atomic.AddInt64(&g.id, 1)
+	if id == 0 {
+		return atomic.AddInt64(&g.id, 1)
+	}
+	return id
+}
+
+func NewCounterIdGenerator() IdGenerator {
+	return new(counterIdGenerator)
+}
+
+const (
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+	snowflakeTimeBits = 31
+
+	SnowflakeMaxNode = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSeq  = 1<<snowflakeSeqBits - 1
+	snowflakeMaxTime = 1<<snowflakeTimeBits - 1
+)
+
+var (
+	// 2020-01-01 00:00:00 UTC
+	SnowflakeEpoch = time.Unix(1577836800, 0)
+)
+
+// 集群唯一的snowflake风格生成器
+//
+// 布局(共53位，保证js客户端的Number精度不丢失)：
+// | 31位 秒级时间戳 | 10位 节点号 | 12位 序列号 |
+//
+// 同一秒内序列号耗尽时阻塞到下一秒，避免重启后重复发放
+type snowflakeIdGenerator struct {
+	mu   sync.Mutex
+	node int64
+	last int64
+	seq  int64
+}
+
+func (g *snowflakeIdGenerator) Next() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := snowflakeNow()
+	if now > g.last {
+		g.last = now
+		g.seq = 0
+	} else {
+		// 时钟回拨或同一秒内
+		g.seq = (g.seq + 1) & snowflakeMaxSeq
+		if g.seq == 0 {
+			for now <= g.last {
+				time.Sleep(time.Until(SnowflakeEpoch.Add(time.Duration(g.last+1) * time.Second)))
+				now = snowflakeNow()
+			}
+			g.last = now
+		}
+	}
+
+	ts := g.last & snowflakeMaxTime
+	return ts<<(snowflakeNodeBits+snowflakeSeqBits) | g.node<<snowflakeSeqBits | g.seq
+}
+
+func snowflakeNow() int64 {
+	return int64(time.Since(SnowflakeEpoch) / time.Second)
+}
+
+func NewSnowflakeIdGenerator(node int64) IdGenerator {
+	if node < 0 || node > SnowflakeMaxNode {
+		panic("snowflake node is out of range")
+	}
+	g := &snowflakeIdGenerator{
+		node: node,
+	}
+	return g
+}
@@ -139,6 +139,13 @@ func (bi *BiMap) AllKeys(output interface{}) bool {
 	}
 }
 
+func (bi *BiMap) Len() int {
+	bi.mu.RLock()
+	defer bi.mu.RUnlock()
+
+	return len(bi.kv)
+}
+
 func NewBiMap() *BiMap {
 	bi := &BiMap{
 		kv: make(map[interface{}]interface{}),
@@ -155,7 +162,8 @@ type BIndex struct {
 	tagToUserSet map[interface{}]set // map[key2] map[key]struct{}
 }
 
-func (bi *BIndex) AddUserTag(user interface{}, tags ...interface{}) {
+// 返回新创建的tag(即之前没有任何user的tag)
+func (bi *BIndex) AddUserTag(user interface{}, tags ...interface{}) (created []interface{}) {
 	bi.mu.Lock()
 	defer bi.mu.Unlock()
 
@@ -178,12 +186,15 @@ func (bi *BIndex) AddUserTag(user interface{}, tags ...interface{}) {
 			// tag不存在，创建新userSet并加入
 			userSet = make(set)
 			bi.tagToUserSet[tag] = userSet
+			created = append(created, tag)
 		}
 		userSet[user] = struct{}{}
 	}
+	return created
 }
 
-func (bi *BIndex) RemoveUserTag(user interface{}, tags ...interface{}) {
+// 返回被删除的tag(即已经没有任何user的tag)
+func (bi *BIndex) RemoveUserTag(user interface{}, tags ...interface{}) (removed []interface{}) {
 	bi.mu.Lock()
 	defer bi.mu.Unlock()
 
@@ -191,7 +202,7 @@ func (bi *BIndex) RemoveUserTag(user interface{}, tags ...interface{}) {
 	tagSet, ok := bi.userToTagSet[user]
 	if !ok {
 		// user不存在
-		return
+		return nil
 	}
 
 	for _, tag := range tags {
@@ -203,14 +214,16 @@ func (bi *BIndex) RemoveUserTag(user interface{}, tags ...interface{}) {
 		// 反向索引
 		userSet, ok := bi.tagToUserSet[tag]
 		if !ok {
-			// tag不存在，创建新userSet并加入
-			return
+			// tag不存在
+			continue
 		}
 		delete(userSet, user)
 		if len(userSet) == 0 {
 			delete(bi.tagToUserSet, tag)
+			removed = append(removed, tag)
 		}
 	}
+	return removed
 }
 
 func (bi *BIndex) Tags(user interface{}, output interface{}) bool {
@@ -335,7 +348,8 @@ func (bi *BIndex) AllUsers(output interface{}) bool {
 	}
 }
 
-func (bi *BIndex) RemoveUser(user interface{}) {
+// 返回被删除的tag(即已经没有任何user的tag)
+func (bi *BIndex) RemoveUser(user interface{}) (removed []interface{}) {
 	bi.mu.Lock()
 	defer bi.mu.Unlock()
 
@@ -343,7 +357,7 @@ func (bi *BIndex) RemoveUser(user interface{}) {
 	tagSet, ok := bi.userToTagSet[user]
 	if !ok {
 		// user不存在
-		return
+		return nil
 	}
 
 	for tag, _ := range tagSet {
@@ -351,10 +365,12 @@ func (bi *BIndex) RemoveUser(user interface{}) {
 		delete(userSet, user)
 		if len(userSet) == 0 {
 			delete(bi.tagToUserSet, tag)
+			removed = append(removed, tag)
 		}
 	}
 
 	delete(bi.userToTagSet, user)
+	return removed
 }
 
 func (bi *BIndex) RemoveTag(tag interface{}) {
@@ -557,6 +573,14 @@ func (i *Index) User(tag interface{}) (interface{}, bool) {
 	return user, ok
 }
 
+// 返回user数
+func (i *Index) Len() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return len(i.userToTagSet)
+}
+
 func NewIndex(reverse bool) *Index {
 	i := &Index{
 		userToTagSet: make(map[interface{}]set),
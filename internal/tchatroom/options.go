@@ -1,7 +1,15 @@
 package tchatroom
 
+import "tpush/internal/twebsocket"
+
 type Options struct {
-	distribute Distribute
+	distribute  Distribute
+	idGen       IdGenerator
+	subs        SubscriptionStore
+	auth        Authenticator
+	upgradeAuth bool
+	wsOpts      []twebsocket.Option
+	mws         []twebsocket.Middleware
 }
 
 type Option func(opt *Options)
@@ -11,3 +19,44 @@ func WithDistribute(distribute Distribute) Option {
 		opt.distribute = distribute
 	}
 }
+
+func WithIdGenerator(idGen IdGenerator) Option {
+	return func(opt *Options) {
+		opt.idGen = idGen
+	}
+}
+
+// 为空时使用进程内存储，分布式下需使用各节点共享的存储
+func WithSubscriptionStore(subs SubscriptionStore) Option {
+	return func(opt *Options) {
+		opt.subs = subs
+	}
+}
+
+// 为空时信任客户端登录时上报的uid
+func WithAuthenticator(auth Authenticator) Option {
+	return func(opt *Options) {
+		opt.auth = auth
+	}
+}
+
+// 要求升级时携带有效token，否则返回401，需同时设置Authenticator
+func WithUpgradeAuth(required bool) Option {
+	return func(opt *Options) {
+		opt.upgradeAuth = required
+	}
+}
+
+// 透传给websocket服务的选项
+func WithWebsocketOptions(opts ...twebsocket.Option) Option {
+	return func(opt *Options) {
+		opt.wsOpts = append(opt.wsOpts, opts...)
+	}
+}
+
+// 追加到访问日志和panic恢复之后的命令中间件
+func WithMiddlewares(mws ...twebsocket.Middleware) Option {
+	return func(opt *Options) {
+		opt.mws = append(opt.mws, mws...)
+	}
+}
@@ -7,11 +7,18 @@ type PingRsp struct {
 }
 
 type LoginReq struct {
-	Uid int64 `json:"uid"`
+	Uid   int64  `json:"uid"`
+	Token string `json:"token,omitempty"` // 启用认证时校验，uid以token中的为准
+
+	// 协商合批发送，只能延长合批窗口(毫秒)或减小最大批量
+	FlushInterval int64 `json:"flush_interval,omitempty" mapstructure:"flush_interval"`
+	MaxBatch      int   `json:"max_batch,omitempty" mapstructure:"max_batch"`
 }
 
 type LoginRsp struct {
-	Id int64 `json:"id"`
+	Id            int64 `json:"id"`
+	FlushInterval int64 `json:"flush_interval" mapstructure:"flush_interval"` // 生效的合批窗口(毫秒)，0为不等待
+	MaxBatch      int   `json:"max_batch" mapstructure:"max_batch"`           // 生效的最大批量，0为不限制
 }
 
 type EnterChanReq struct {
@@ -31,6 +38,7 @@ type ExitChanRsp struct {
 type SendToClientReq struct {
 	Ids  []int64     `json:"ids"`
 	Data interface{} `json:"data,omitempty"`
+	Key  string      `json:"key,omitempty"` // 合并key，参见RecvDataRsp
 }
 
 type SendToClientRsp struct {
@@ -39,6 +47,7 @@ type SendToClientRsp struct {
 type SendToUserReq struct {
 	Uids []int64     `json:"uids"`
 	Data interface{} `json:"data,omitempty"`
+	Key  string      `json:"key,omitempty"`
 }
 
 type SendToUserRsp struct {
@@ -47,6 +56,7 @@ type SendToUserRsp struct {
 type SendToChanReq struct {
 	Chans []string    `json:"chans"`
 	Data  interface{} `json:"data,omitempty"`
+	Key   string      `json:"key,omitempty"`
 }
 
 type SendToChanRsp struct {
@@ -60,4 +70,19 @@ type RecvDataRsp struct {
 	Uid  int64       `json:"uid"`
 	Chan string      `json:"chan"`
 	Data interface{} `json:"data,omitempty"`
+	// 合并key，客户端尚未收到的同频道同key的数据只保留最新的一条
+	Key string `json:"key,omitempty"`
+}
+
+const (
+	NoticeKick = "kick" // 被服务端踢下线，随后连接将被关闭
+)
+
+type NoticeReq struct {
+}
+
+type NoticeRsp struct {
+	Type   string `json:"type"`
+	Code   int32  `json:"code"`
+	Reason string `json:"reason,omitempty"`
 }
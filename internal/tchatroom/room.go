@@ -2,37 +2,36 @@ package tchatroom
 
 import (
 	"fmt"
-	"sync/atomic"
+	log "github.com/micro/go-micro/v2/logger"
+	"strconv"
+	"sync"
 	"tpush/internal/twebsocket"
 )
 
-var (
-	cliId int64 = 0
-)
-
-func genid() int64 {
-	id := atomic.AddInt64(&cliId, 1)
-	if id == 0 {
-		return atomic.AddInt64(&cliId, 1)
-	}
-	return id
-}
-
 type Room struct {
 	clients *BiMap  // id <-> Client
 	where   *BIndex // Client -> channel set, channel -> Client set
 	who     *Index  // uid -> Client set
 
+	whereMu sync.Mutex // 频道索引的更新与注册/注销在同一临界区内，保证传递顺序与索引变化一致
+
+	subs SubscriptionStore // 服务端为用户持久订阅的频道，登录时自动进入
+
 	distribute Distribute
+	idGen      IdGenerator
 }
 
 func (r *Room) AddClient(cli twebsocket.Client) int64 {
-	id := genid()
+	id := r.idGen.Next()
 	r.clients.AddPair(id, cli)
 	return id
 }
 
 func (r *Room) Login(cli twebsocket.Client, uid int64) {
+	if _, ok := r.who.User(cli); ok {
+		// 已登录，避免重复注册
+		return
+	}
 	r.who.AddUserTag(uid, cli)
 
 	if r.distribute != nil {
@@ -41,6 +40,50 @@ func (r *Room) Login(cli twebsocket.Client, uid int64) {
 			r.distribute.Register(fmt.Sprintf(RegUserKeyFmt, uid))
 		}
 	}
+
+	chs, err := r.subs.Channels(uid)
+	if err != nil {
+		log.Errorf("load subscriptions of %d err, %v", uid, err)
+	}
+	if len(chs) > 0 {
+		r.ClientEnterChannel(cli, chs...)
+	}
+}
+
+// 让用户当前的所有连接进入频道，persist为true时之后登录的连接也会自动进入，返回受影响的连接数
+func (r *Room) SubscribeUser(uids []int64, chs []string, persist bool) (int, error) {
+	if persist {
+		chs_ := make([]string, 0, len(chs))
+		for _, ch := range chs {
+			if len(ch) != 0 {
+				chs_ = append(chs_, ch)
+			}
+		}
+		if err := r.subs.Subscribe(uids, chs_); err != nil {
+			return 0, err
+		}
+	}
+
+	var clis []twebsocket.Client
+	r.ClientsOfUsers(uids).Clients(&clis)
+	for _, cli := range clis {
+		r.ClientEnterChannel(cli, chs...)
+	}
+	return len(clis), nil
+}
+
+// 让用户当前的所有连接离开频道，同时取消持久订阅，返回受影响的连接数
+func (r *Room) UnsubscribeUser(uids []int64, chs []string) (int, error) {
+	if err := r.subs.Unsubscribe(uids, chs); err != nil {
+		return 0, err
+	}
+
+	var clis []twebsocket.Client
+	r.ClientsOfUsers(uids).Clients(&clis)
+	for _, cli := range clis {
+		r.ClientExitChannel(cli, chs...)
+	}
+	return len(clis), nil
 }
 
 func (r *Room) ClientsOfUser(uid int64) (twebsocket.ClientGroup, bool) {
@@ -72,7 +115,9 @@ func (r *Room) RemoveClient(cli twebsocket.Client) {
 	}
 
 	r.clients.RemoveByValue(cli)
-	r.where.RemoveUser(cli)
+	r.whereMu.Lock()
+	r.unregisterChannels(r.where.RemoveUser(cli))
+	r.whereMu.Unlock()
 	r.who.RemoveTag(cli)
 }
 
@@ -83,7 +128,17 @@ func (r *Room) ClientEnterChannel(cli twebsocket.Client, chs ...string) {
 			chs_ = append(chs_, ch)
 		}
 	}
-	r.where.AddUserTag(cli, chs_...)
+	r.whereMu.Lock()
+	defer r.whereMu.Unlock()
+
+	created := r.where.AddUserTag(cli, chs_...)
+
+	// 节点上第一个进入频道的客户端负责注册
+	if r.distribute != nil {
+		for _, ch := range created {
+			r.distribute.Register(fmt.Sprintf(RegChannelKeyFmt, ch))
+		}
+	}
 }
 
 func (r *Room) ClientExitChannel(cli twebsocket.Client, chs ...string) {
@@ -91,7 +146,19 @@ func (r *Room) ClientExitChannel(cli twebsocket.Client, chs ...string) {
 	for i, ch := range chs {
 		chs_[i] = ch
 	}
-	r.where.RemoveUserTag(cli, chs_...)
+	r.whereMu.Lock()
+	defer r.whereMu.Unlock()
+
+	r.unregisterChannels(r.where.RemoveUserTag(cli, chs_...))
+}
+
+// 节点上最后一个离开频道的客户端负责注销，需持有r.whereMu
+func (r *Room) unregisterChannels(chs []interface{}) {
+	if r.distribute != nil {
+		for _, ch := range chs {
+			r.distribute.Unregister(fmt.Sprintf(RegChannelKeyFmt, ch))
+		}
+	}
 }
 
 func (r *Room) ClientsInChannel(ch string) (twebsocket.ClientGroup, bool) {
@@ -151,13 +218,210 @@ func (r *Room) User(cli twebsocket.Client) (int64, bool) {
 	}
 }
 
-func NewRoom(distribute Distribute) *Room {
+func NewRoom(distribute Distribute, idGen IdGenerator, subs SubscriptionStore) *Room {
+	if idGen == nil {
+		idGen = NewCounterIdGenerator()
+	}
+	if subs == nil {
+		subs = NewMemorySubscriptionStore()
+	}
 	r := &Room{
 		clients: NewBiMap(),
 		where:   NewBIndex(),
 		who:     NewIndex(true),
 
-		distribute: distribute,
+		subs: subs,
+
+		idGen: idGen,
+	}
+	if distribute != nil {
+		// 同一用户的多个客户端共用一个注册key
+		r.distribute = NewRefCountDistribute(distribute)
 	}
 	return r
 }
+
+// 单个推送目标的投递统计
+type Delivery struct {
+	Target   string
+	Matched  int // 匹配到的客户端数
+	Enqueued int // 成功写入发送队列的客户端数
+	Dropped  int // 因连接已关闭而丢弃的客户端数
+}
+
+type delivery struct {
+	*Delivery
+	cligrp twebsocket.ClientGroup
+	ch     string
+}
+
+// wait为true时同步写入并统计写入结果，否则仅统计匹配数并异步写入
+func (r *Room) deliver(ds []delivery, data *RecvDataRsp, wait bool) []*Delivery {
+	ret := make([]*Delivery, len(ds))
+	for i, d := range ds {
+		if d.cligrp != nil {
+			d.Matched = d.cligrp.Len()
+		}
+		ret[i] = d.Delivery
+	}
+
+	write := func() {
+		for _, d := range ds {
+			if d.Matched == 0 {
+				continue
+			}
+			data := *data
+			if len(d.ch) != 0 {
+				data.Chan = d.ch
+			}
+			var opts []twebsocket.WriteOption
+			if len(d.ch) != 0 {
+				// 频道广播让位于回应及定向推送
+				opts = append(opts, twebsocket.WithPriority(twebsocket.PriorityBulk))
+			}
+			if len(data.Key) != 0 {
+				// 不同频道的相同key互不替换
+				opts = append(opts, twebsocket.WithConflationKey(data.Chan+"/"+data.Key))
+			}
+			n := d.cligrp.Write(CmdRecvData, 0, &data, 0, "", opts...)
+			if wait {
+				d.Enqueued = n
+				d.Dropped = d.Matched - n
+			}
+		}
+	}
+
+	if wait {
+		write()
+	} else {
+		go write()
+	}
+	return ret
+}
+
+func (r *Room) SendToClients(ids []int64, data *RecvDataRsp, wait bool) []*Delivery {
+	ds := make([]delivery, len(ids))
+	for i, id := range ids {
+		ds[i].Delivery = &Delivery{Target: strconv.FormatInt(id, 10)}
+		if cli, ok := r.clients.Value(id); ok {
+			ds[i].cligrp = twebsocket.NewClientGroup([]interface{}{cli})
+		}
+	}
+	return r.deliver(ds, data, wait)
+}
+
+func (r *Room) SendToUsers(uids []int64, data *RecvDataRsp, wait bool) []*Delivery {
+	ds := make([]delivery, len(uids))
+	for i, uid := range uids {
+		ds[i].Delivery = &Delivery{Target: strconv.FormatInt(uid, 10)}
+		if cligrp, ok := r.ClientsOfUser(uid); ok {
+			ds[i].cligrp = cligrp
+		}
+	}
+	return r.deliver(ds, data, wait)
+}
+
+func (r *Room) SendToChannels(chs []string, data *RecvDataRsp, wait bool) []*Delivery {
+	ds := make([]delivery, len(chs))
+	for i, ch := range chs {
+		ds[i].Delivery = &Delivery{Target: ch}
+		ds[i].ch = ch
+		if cligrp, ok := r.ClientsInChannel(ch); ok {
+			ds[i].cligrp = cligrp
+		}
+	}
+	return r.deliver(ds, data, wait)
+}
+
+// 在线客户端信息
+type ClientInfo struct {
+	Id  int64
+	Uid int64
+}
+
+// 返回uids中在本节点上有客户端在线的用户
+func (r *Room) OnlineUsers(uids []int64) []int64 {
+	online := make([]int64, 0, len(uids))
+	var out []interface{}
+	for _, uid := range uids {
+		if ok := r.who.Tags(uid, &out); ok {
+			online = append(online, uid)
+		}
+	}
+	return online
+}
+
+func (r *Room) ClientIdsOfUser(uid int64) []int64 {
+	var out []interface{}
+	if ok := r.who.Tags(uid, &out); !ok {
+		return nil
+	}
+	ids := make([]int64, 0, len(out))
+	for _, cli := range out {
+		if id, ok := r.clients.Key(cli); ok {
+			ids = append(ids, id.(int64))
+		}
+	}
+	return ids
+}
+
+func (r *Room) ChannelMembers(ch string) []*ClientInfo {
+	var out []interface{}
+	if ok := r.where.Users(ch, &out); !ok {
+		return nil
+	}
+	members := make([]*ClientInfo, 0, len(out))
+	for _, cli_ := range out {
+		cli := cli_.(twebsocket.Client)
+		id, ok := r.ClientId(cli)
+		if !ok {
+			continue
+		}
+		uid, _ := r.User(cli)
+		members = append(members, &ClientInfo{Id: id, Uid: uid})
+	}
+	return members
+}
+
+func (r *Room) ChannelsOfClient(id int64) ([]string, bool) {
+	cli, ok := r.clients.Value(id)
+	if !ok {
+		return nil, false
+	}
+	var out []interface{}
+	r.where.Tags(cli, &out)
+	chs := make([]string, len(out))
+	for i, ch := range out {
+		chs[i] = ch.(string)
+	}
+	return chs, true
+}
+
+// 返回本节点的连接数及已登录用户数
+func (r *Room) CountOnline() (clients, users int) {
+	return r.clients.Len(), r.who.Len()
+}
+
+// 向ids、uids、chans匹配到的连接发送踢下线通知后关闭连接，返回被踢的连接数
+func (r *Room) Kick(ids []int64, uids []int64, chs []string, code int32, reason string) int {
+	kicked := make(map[twebsocket.Client]struct{})
+	var clis []twebsocket.Client
+	for _, cligrp := range []twebsocket.ClientGroup{r.Clients(ids), r.ClientsOfUsers(uids), r.ClientsInChannels(chs)} {
+		cligrp.Clients(&clis)
+		for _, cli := range clis {
+			kicked[cli] = struct{}{}
+		}
+	}
+
+	notice := &NoticeRsp{
+		Type:   NoticeKick,
+		Code:   code,
+		Reason: reason,
+	}
+	for cli := range kicked {
+		// 控制消息在关闭连接前发出
+		cli.Write(CmdNotice, 0, notice, 0, "", twebsocket.WithPriority(twebsocket.PriorityControl))
+		cli.Close()
+	}
+	return len(kicked)
+}
@@ -1,6 +1,8 @@
 package tchatroom
 
 import (
+	"encoding/json"
+	log "github.com/micro/go-micro/v2/logger"
 	"net/http"
 	"runtime"
 	"time"
@@ -16,6 +18,7 @@ const (
 	CmdSendToUser   = "snd2usr"
 	CmdSendToChan   = "snd2chan"
 	CmdRecvData     = "rcvdata"
+	CmdNotice       = "notice" // 服务端通知，仅由服务端发出
 
 	ErrNotLogin       = -11
 	ErrLoginFailed    = -12
@@ -31,16 +34,62 @@ var (
 	RecvTimeout   = time.Second * 30
 	LoginTimeout  = time.Second * 2
 	StreamPattern = "/stream"
+	StatsPattern  = "/debug/ws/stats"
+
+	// 管理接口(发送统计、pprof)的监听地址，与面向客户端的地址分开，为空时不启动
+	AdminAddress = "127.0.0.1:6060"
+
+	// 客户端登录时可协商的最大合批窗口
+	MaxFlushInterval = time.Second
+
+	// 升级时携带token的cookie名及查询参数名，也可使用"Authorization: Bearer <token>"头
+	// 优先使用请求头或cookie，查询参数中的token会被代理写入访问日志
+	TokenCookieName = "token"
+	TokenQueryKey   = "token"
 )
 
 type Service struct {
-	mux  *twebsocket.ServeMux
-	Room *Room
-	opt  *Options
+	ws       twebsocket.WritePumpHttpHandler
+	mux      *twebsocket.ServeMux
+	httpMux  *http.ServeMux
+	adminMux *http.ServeMux
+	Room     *Room
+	opt      *Options
+}
+
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.httpMux.ServeHTTP(w, r)
+}
+
+// websocket发送统计
+func (s *Service) Stats() twebsocket.Stats {
+	return s.ws.Stats()
+}
+
+// 管理接口，不应暴露给客户端
+func (s *Service) AdminHandler() http.Handler {
+	return s.adminMux
+}
+
+func (s *Service) serveStats(w http.ResponseWriter, r *http.Request) {
+	stats := s.Stats()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&struct {
+		twebsocket.Stats
+		Ratio float64 `json:"ratio"`
+	}{stats, stats.Ratio()})
 }
 
 func (s *Service) Run() error {
-	return http.ListenAndServe(Address, nil)
+	if len(AdminAddress) != 0 {
+		go func() {
+			log.Infof("Server [admin] Listening on %s", AdminAddress)
+			if err := http.ListenAndServe(AdminAddress, s.adminMux); err != nil {
+				log.Error("Server [admin] Listening err: ", err)
+			}
+		}()
+	}
+	return http.ListenAndServe(Address, s)
 }
 
 func NewService(opts ...Option) *Service {
@@ -49,38 +98,52 @@ func NewService(opts ...Option) *Service {
 		o(opt)
 	}
 
-	r := NewRoom(opt.distribute)
+	r := NewRoom(opt.distribute, opt.idGen, opt.subs)
 
 	h := &handler{
-		room: r,
+		room:        r,
+		auth:        opt.auth,
+		upgradeAuth: opt.upgradeAuth,
 	}
 	mux := twebsocket.NewServeMux()
-	mux.HandleFunc(CmdPing, h.Ping)
-	mux.HandleFunc(CmdLogin, h.Login)
-	mux.HandleFunc(CmdEnter, h.EnterChan)
-	mux.HandleFunc(CmdExit, h.ExitChan)
-	mux.HandleFunc(CmdSendToClient, h.SendToClient)
-	mux.HandleFunc(CmdSendToUser, h.SendToUser)
-	mux.HandleFunc(CmdSendToChan, h.SendToChan)
+	mux.Use(twebsocket.AccessLog(log.DebugLevel), twebsocket.Recovery())
+	mux.Use(opt.mws...)
+	mux.Handle(CmdPing, h.Ping)
+	mux.Handle(CmdLogin, h.Login)
+	mux.Handle(CmdEnter, h.EnterChan)
+	mux.Handle(CmdExit, h.ExitChan)
+	mux.Handle(CmdSendToClient, h.SendToClient)
+	mux.Handle(CmdSendToUser, h.SendToUser)
+	mux.Handle(CmdSendToChan, h.SendToChan)
 	mux.HandleFunc(CmdRecvData, h.RecvData)
-	ws := twebsocket.Server(
+	mux.HandleFunc(CmdNotice, h.Notice)
+	wsOpts := []twebsocket.Option{
 		twebsocket.WithServeMux(mux),
 		twebsocket.WithRecvTimeout(RecvTimeout),
 		twebsocket.WithUpgradeHandler(h.OpUpgrade),
 		twebsocket.WithOpenHandler(h.OnOpen),
 		twebsocket.WithCloseHandler(h.OnClose),
-	)
+	}
+	ws := twebsocket.Server(append(wsOpts, opt.wsOpts...)...)
 	ws.StartWritePumps(runtime.NumCPU())
 
-	// 注册web服务处理器
-	http.Handle(StreamPattern, ws)
+	// 注册web服务处理器，每个服务实例使用独立的路由，便于同一进程内运行多个实例
+	httpMux := http.NewServeMux()
+	httpMux.Handle(StreamPattern, ws)
+	httpMux.Handle("/", http.FileServer(http.Dir("html")))
 
-	http.Handle("/", http.FileServer(http.Dir("html")))
+	// 管理接口使用独立的路由及地址
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/debug/pprof/", http.DefaultServeMux)
 
 	s := &Service{
-		mux:  mux,
-		Room: r,
-		opt:  opt,
+		ws:       ws,
+		mux:      mux,
+		httpMux:  httpMux,
+		adminMux: adminMux,
+		Room:     r,
+		opt:      opt,
 	}
+	adminMux.HandleFunc(StatsPattern, s.serveStats)
 	return s
 }
@@ -0,0 +1,200 @@
+package tchatroom
+
+import (
+	"context"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/go-redis/redis/v7"
+	"strings"
+	"sync"
+)
+
+const (
+	RegSubscriptionKeyFmt = "/subs/%d" // 用户的持久订阅
+)
+
+// 用户的持久订阅，之后登录的连接自动进入这些频道
+// 分布式下需使用各节点共享的存储，使之后启动的节点也能读取到
+type SubscriptionStore interface {
+	Subscribe(uids []int64, chs []string) error
+	Unsubscribe(uids []int64, chs []string) error
+	Channels(uid int64) ([]string, error)
+}
+
+// 进程内的持久订阅，仅用于单节点部署，只有显式取消订阅才会移除
+type memorySubscriptionStore struct {
+	mu   sync.RWMutex
+	subs map[int64]map[string]struct{} // uid -> channel set
+}
+
+func (s *memorySubscriptionStore) Subscribe(uids []int64, chs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, uid := range uids {
+		set, ok := s.subs[uid]
+		if !ok {
+			set = make(map[string]struct{})
+			s.subs[uid] = set
+		}
+		for _, ch := range chs {
+			set[ch] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func (s *memorySubscriptionStore) Unsubscribe(uids []int64, chs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, uid := range uids {
+		set, ok := s.subs[uid]
+		if !ok {
+			continue
+		}
+		for _, ch := range chs {
+			delete(set, ch)
+		}
+		if len(set) == 0 {
+			delete(s.subs, uid)
+		}
+	}
+	return nil
+}
+
+func (s *memorySubscriptionStore) Channels(uid int64) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	set := s.subs[uid]
+	chs := make([]string, 0, len(set))
+	for ch := range set {
+		chs = append(chs, ch)
+	}
+	return chs, nil
+}
+
+func NewMemorySubscriptionStore() SubscriptionStore {
+	s := &memorySubscriptionStore{
+		subs: make(map[int64]map[string]struct{}),
+	}
+	return s
+}
+
+// 每个订阅为一个不带租约的key："/subs/uid/channel"
+type etcdSubscriptionStore struct {
+	kv clientv3.KV
+}
+
+func (s *etcdSubscriptionStore) commit(uids []int64, chs []string, op func(key string) clientv3.Op) error {
+	ops := make([]clientv3.Op, 0, etcdMaxTxnOps)
+	flush := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), etcdClientTimeout)
+		defer cancel()
+		_, err := s.kv.Txn(ctx).Then(ops...).Commit()
+		ops = ops[:0]
+		return err
+	}
+
+	for _, uid := range uids {
+		for _, ch := range chs {
+			ops = append(ops, op(fmt.Sprintf(RegSubscriptionKeyFmt+"/%s", uid, ch)))
+			if len(ops) == etcdMaxTxnOps {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if len(ops) > 0 {
+		return flush()
+	}
+	return nil
+}
+
+func (s *etcdSubscriptionStore) Subscribe(uids []int64, chs []string) error {
+	return s.commit(uids, chs, func(key string) clientv3.Op {
+		return clientv3.OpPut(key, "")
+	})
+}
+
+func (s *etcdSubscriptionStore) Unsubscribe(uids []int64, chs []string) error {
+	return s.commit(uids, chs, func(key string) clientv3.Op {
+		return clientv3.OpDelete(key)
+	})
+}
+
+func (s *etcdSubscriptionStore) Channels(uid int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdClientTimeout)
+	defer cancel()
+
+	prefix := fmt.Sprintf(RegSubscriptionKeyFmt+"/", uid)
+	getRsp, err := s.kv.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	chs := make([]string, 0, len(getRsp.Kvs))
+	for _, kv := range getRsp.Kvs {
+		chs = append(chs, strings.TrimPrefix(string(kv.Key), prefix))
+	}
+	return chs, nil
+}
+
+func NewEtcdSubscriptionStore(kv clientv3.KV) SubscriptionStore {
+	return &etcdSubscriptionStore{kv: kv}
+}
+
+// 每个用户的持久订阅为一个集合
+type redisSubscriptionStore struct {
+	store *redis.Client
+}
+
+func (s *redisSubscriptionStore) client() (*redis.Client, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisClientTimeout)
+	return s.store.WithContext(ctx), cancel
+}
+
+func (s *redisSubscriptionStore) commit(uids []int64, chs []string, cmd func(pipe redis.Pipeliner, key string, members []interface{})) error {
+	if len(chs) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(chs))
+	for i, ch := range chs {
+		members[i] = ch
+	}
+
+	cli, cancel := s.client()
+	defer cancel()
+
+	_, err := cli.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, uid := range uids {
+			cmd(pipe, fmt.Sprintf(RegSubscriptionKeyFmt, uid), members)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisSubscriptionStore) Subscribe(uids []int64, chs []string) error {
+	return s.commit(uids, chs, func(pipe redis.Pipeliner, key string, members []interface{}) {
+		pipe.SAdd(key, members...)
+	})
+}
+
+func (s *redisSubscriptionStore) Unsubscribe(uids []int64, chs []string) error {
+	return s.commit(uids, chs, func(pipe redis.Pipeliner, key string, members []interface{}) {
+		pipe.SRem(key, members...)
+	})
+}
+
+func (s *redisSubscriptionStore) Channels(uid int64) ([]string, error) {
+	cli, cancel := s.client()
+	defer cancel()
+
+	return cli.SMembers(fmt.Sprintf(RegSubscriptionKeyFmt, uid)).Result()
+}
+
+func NewRedisSubscriptionStore(store *redis.Client) SubscriptionStore {
+	return &redisSubscriptionStore{store: store}
+}
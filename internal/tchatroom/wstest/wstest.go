@@ -0,0 +1,65 @@
+// 测试用的websocket客户端，按json编解码收发请求
+package wstest
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"tpush/internal/tchatroom"
+	"tpush/internal/twebsocket"
+)
+
+type Client struct {
+	Conn *websocket.Conn
+	seq  int64
+}
+
+func (c *Client) Request(cmd string, data interface{}) error {
+	c.seq++
+	return c.Conn.WriteJSON([]*twebsocket.RequestData{{Cmd: cmd, Seq: c.seq, Data: data}})
+}
+
+// 读取到指定命令的响应为止，其余响应丢弃
+func (c *Client) Recv(cmd string, timeout time.Duration) (*twebsocket.ResponseData, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		c.Conn.SetReadDeadline(deadline)
+		var rsps []*twebsocket.ResponseData
+		if err := c.Conn.ReadJSON(&rsps); err != nil {
+			return nil, err
+		}
+		for _, rsp := range rsps {
+			if rsp.Cmd == cmd {
+				return rsp, nil
+			}
+		}
+	}
+}
+
+// 服务的websocket地址
+func URL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + tchatroom.StreamPattern
+}
+
+// 连接并以uid登录，失败时结束测试
+func Login(t testing.TB, srv *httptest.Server, uid int64) (*Client, *tchatroom.LoginRsp) {
+	conn, _, err := websocket.DefaultDialer.Dial(URL(srv), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{Conn: conn}
+	if err := c.Request(tchatroom.CmdLogin, &tchatroom.LoginReq{Uid: uid}); err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := c.Recv(tchatroom.CmdLogin, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var login tchatroom.LoginRsp
+	if err := twebsocket.DecodeData(rsp.Data, &login); err != nil {
+		t.Fatal(err)
+	}
+	return c, &login
+}
@@ -3,38 +3,65 @@ package twebsocket
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"github.com/gorilla/websocket"
 	log "github.com/micro/go-micro/v2/logger"
-	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Writer interface {
-	Write(cmd string, seq int64, data interface{}, code int32, msg string, immed bool)
+	// 返回成功写入的客户端数，已关闭的客户端不计入
+	Write(cmd string, seq int64, data interface{}, code int32, msg string, opts ...WriteOption) int
+}
+
+type writeOptions struct {
+	key      string
+	priority Priority
+}
+
+type WriteOption func(o *writeOptions)
+
+// 待发送队列中已有相同key的消息时替换之，慢客户端只收到每个key的最新值
+func WithConflationKey(key string) WriteOption {
+	return func(o *writeOptions) {
+		o.key = key
+	}
+}
+
+// 默认为PriorityNormal
+func WithPriority(priority Priority) WriteOption {
+	return func(o *writeOptions) {
+		o.priority = priority
+	}
+}
+
+func newWriteOptions(opts []WriteOption) writeOptions {
+	o := writeOptions{priority: PriorityNormal}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
 }
 
 type Client interface {
 	Writer
 	ContextValue(key interface{}) interface{}
 	AddContextValue(key, value interface{})
+	// 当前的合批窗口及最大批量，参见WithBatching
+	Batching() (interval time.Duration, maxBatch int)
+	SetBatching(interval time.Duration, maxBatch int)
 	Close()
 }
 
 type ClientGroup interface {
 	Writer
 	Clients(output *[]Client)
+	Len() int
 }
 
-var (
-	leftSB  = []byte("[")
-	rightSB = []byte("]")
-	comma   = []byte(",")
-)
-
 type clientGroup struct {
 	clients []interface{}
 }
@@ -50,9 +77,9 @@ func (cg *clientGroup) Clients(output *[]Client) {
 	}
 }
 
-func (cg *clientGroup) Write(cmd string, seq int64, data interface{}, code int32, msg string, immed bool) {
+func (cg *clientGroup) Write(cmd string, seq int64, data interface{}, code int32, msg string, opts ...WriteOption) int {
 	if len(cg.clients) == 0 {
-		return
+		return 0
 	}
 
 	rspData := &ResponseData{
@@ -63,18 +90,33 @@ func (cg *clientGroup) Write(cmd string, seq int64, data interface{}, code int32
 		Data: EncodeData(data),
 	}
 
-	log.Debug("clientgroup begin to encode")
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(rspData); err != nil {
-		return
-	}
+	o := newWriteOptions(opts)
 
+	// 每种编解码器只编码一次
 	log.Debug("clientgroup begin to write")
+	encoded := make(map[Codec][]byte, 1)
+	n := 0
 	for _, c := range cg.clients {
 		cli := c.(*client)
-		cli.write(buf.Bytes(), immed)
+		item, ok := encoded[cli.codec]
+		if !ok {
+			var err error
+			if item, err = cli.codec.EncodeResponse(rspData); err != nil {
+				log.Error(err)
+				return n
+			}
+			encoded[cli.codec] = item
+		}
+		if cli.write(item, o) {
+			n++
+		}
 	}
 	log.Debug("clientgroup write complete")
+	return n
+}
+
+func (cg *clientGroup) Len() int {
+	return len(cg.clients)
 }
 
 func NewClientGroup(clients []interface{}) ClientGroup {
@@ -85,16 +127,26 @@ func NewClientGroup(clients []interface{}) ClientGroup {
 }
 
 type client struct {
-	svc         *server
-	conn        *websocket.Conn
-	ctx         context.Context
-	writeq      [][]byte
-	mu          sync.Mutex
-	closed      bool
-	sendMu      sync.Mutex
-	immedWriter bytes.Buffer
-	recvTimeout time.Duration
-	sendTimeout time.Duration
+	svc           *server
+	conn          *websocket.Conn
+	ctx           context.Context
+	codec         Codec
+	writeq        [numPriorities]writeQueue // 按优先级排列，发送时由codec合并为一帧
+	batch         [][]byte
+	ready         bool // 已加入服务端的待发送队列
+	scheduled     bool // 合批窗口计时中
+	flushGen      int  // 区分已失效的窗口定时器
+	flushTimer    *time.Timer
+	flushInterval time.Duration
+	maxBatch      int
+	overflowed    bool // 因队列溢出正在断开，不再接受写入
+	closing       bool // 等待写协程发出控制消息后关闭连接
+	mu            sync.Mutex
+	closed        bool
+	sendMu        sync.Mutex
+	recvTimeout   time.Duration
+	sendTimeout   time.Duration
+	compress      bool // 已协商permessage-deflate
 }
 
 func (c *client) ContextValue(key interface{}) interface{} {
@@ -105,8 +157,43 @@ func (c *client) AddContextValue(key, value interface{}) {
 	c.ctx = context.WithValue(c.ctx, key, value)
 }
 
+func (c *client) Batching() (time.Duration, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushInterval, c.maxBatch
+}
+
+// 对之后的合批窗口生效
+func (c *client) SetBatching(interval time.Duration, maxBatch int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushInterval = interval
+	c.maxBatch = maxBatch
+}
+
+// 有待发送的控制消息时交由写协程发出后关闭，最多等待sendTimeout，其余消息丢弃
 func (c *client) Close() {
-	_ = c.conn.Close()
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return
+	}
+	if c.closed || len(c.writeq[PriorityControl].items) == 0 {
+		c.mu.Unlock()
+		_ = c.conn.Close()
+		return
+	}
+
+	c.closing = true
+	for p := PriorityHigh; int(p) < numPriorities; p++ {
+		c.writeq[p].reset()
+	}
+	c.schedule()
+	c.mu.Unlock()
+
+	time.AfterFunc(c.sendTimeout, func() {
+		_ = c.conn.Close()
+	})
 }
 
 func (c *client) shutdown() {
@@ -116,17 +203,31 @@ func (c *client) shutdown() {
 		return
 	}
 
-	_ = c.conn.Close()
+	if !c.closing {
+		_ = c.conn.Close()
+	}
 	//c.writeTimer.Reset(0)
 	c.closed = true
+	// 释放未发送的消息，正在关闭时控制消息由写协程发送后释放
+	for p := range c.writeq {
+		if c.closing && Priority(p) == PriorityControl {
+			continue
+		}
+		c.writeq[p].reset()
+	}
+	c.batch = nil
 	c.mu.Unlock()
 
+	c.svc.mu.Lock()
+	delete(c.svc.clients, c)
+	c.svc.mu.Unlock()
+
 	if c.svc.opt.closeHandler != nil {
 		c.svc.opt.closeHandler(c)
 	}
 }
 
-func (c *client) Write(cmd string, seq int64, data interface{}, code int32, msg string, immed bool) {
+func (c *client) Write(cmd string, seq int64, data interface{}, code int32, msg string, opts ...WriteOption) int {
 	rspData := &ResponseData{
 		Cmd:  cmd,
 		Seq:  seq,
@@ -135,62 +236,209 @@ func (c *client) Write(cmd string, seq int64, data interface{}, code int32, msg
 		Data: EncodeData(data),
 	}
 
-	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(rspData); err != nil {
+	item, err := c.codec.EncodeResponse(rspData)
+	if err != nil {
+		log.Error(err)
+		return 0
+	}
+	if c.write(item, newWriteOptions(opts)) {
+		return 1
+	}
+	return 0
+}
+
+// 连接已关闭或消息被丢弃时返回false
+func (c *client) write(item []byte, o writeOptions) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || c.closing || c.overflowed {
+		return false
+	}
+
+	q := &c.writeq[o.priority]
+	if len(o.key) != 0 {
+		if size, ok := q.replace(item, o.key); ok {
+			c.svc.stats.addConflated(size)
+			return true
+		}
+	}
+
+	if o.priority != PriorityControl && c.full(len(item)) {
+		switch c.svc.opt.overflowPolicy {
+		case DropNewest:
+			c.svc.stats.addDropped(1, len(item))
+			return false
+		case Disconnect:
+			n, size := c.pending()
+			c.svc.stats.addDropped(n+1, size+len(item))
+			atomic.AddInt64(&c.svc.stats.slowDisconnects, 1)
+			for p := range c.writeq {
+				c.writeq[p].reset()
+			}
+			c.overflowed = true
+			// 慢客户端的写入可能阻塞到超时，不占用调用方
+			go c.closeWith(websocket.ClosePolicyViolation, "slow consumer")
+			return false
+		default:
+			// 从最低优先级开始丢弃最早的消息，不丢弃优先级高于新消息的
+			n, size := 0, 0
+			for c.full(len(item)) {
+				p := numPriorities - 1
+				for ; p >= int(o.priority) && len(c.writeq[p].items) == 0; p-- {
+				}
+				if p < int(o.priority) {
+					c.svc.stats.addDropped(n+1, size+len(item))
+					return false
+				}
+				n++
+				size += len(c.writeq[p].items[0])
+				c.writeq[p].drop(1)
+			}
+			c.svc.stats.addDropped(n, size)
+		}
+	}
+
+	q.push(item, o.key)
+	c.schedule()
+	return true
+}
+
+// 待发送的消息数及字节数
+func (c *client) pending() (n, size int) {
+	for p := range c.writeq {
+		n += len(c.writeq[p].items)
+		size += c.writeq[p].bytes
+	}
+	return n, size
+}
+
+// 有控制消息、未设置合批窗口或已达最大批量时加入待发送队列，否则开始计时
+func (c *client) schedule() {
+	n, _ := c.pending()
+	if c.ready || n == 0 {
 		return
 	}
-	c.write(buf.Bytes(), immed)
+	if len(c.writeq[PriorityControl].items) > 0 || c.flushInterval <= 0 || (c.maxBatch > 0 && n >= c.maxBatch) {
+		if c.scheduled {
+			c.scheduled = false
+			c.flushTimer.Stop()
+		}
+		c.ready = true
+		c.svc.ready.push(c)
+		return
+	}
+	if !c.scheduled {
+		c.scheduled = true
+		c.flushGen++
+		gen := c.flushGen
+		c.flushTimer = time.AfterFunc(c.flushInterval, func() {
+			c.flush(gen)
+		})
+	}
 }
 
-func (c *client) write(json []byte, immed bool) {
+// 合批窗口到期
+func (c *client) flush(gen int) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if immed {
-		c.immedWriter.Reset()
-		c.immedWriter.WriteByte(leftSB[0])
-		c.immedWriter.Write(json)
-		c.immedWriter.WriteByte(rightSB[0])
-		c.send(c.immedWriter.Bytes())
+	if c.closed || !c.scheduled || gen != c.flushGen {
 		return
 	}
+	c.scheduled = false
+	if n, _ := c.pending(); !c.ready && n > 0 {
+		c.ready = true
+		c.svc.ready.push(c)
+	}
+}
 
-	if len(c.writeq) == 0 {
-		c.writeq = append(c.writeq, leftSB, json)
-		c.svc.ready <- c
-	} else {
-		c.writeq = append(c.writeq, comma, json)
+// 加入size字节的消息后是否超过上限，队列为空时总是可以加入
+func (c *client) full(size int) bool {
+	n, bytes := c.pending()
+	if n == 0 {
+		return false
 	}
+	opt := c.svc.opt
+	return (opt.maxQueueMessages > 0 && n+1 > opt.maxQueueMessages) ||
+		(opt.maxQueueBytes > 0 && bytes+size > opt.maxQueueBytes)
 }
 
-func (c *client) swap(writer io.Writer) (closed bool) {
+// 按优先级取出一批消息写入buf，返回true时写出后需关闭连接
+func (c *client) swap(buf *bytes.Buffer) (closeAfter bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.closed {
+	c.ready = false
+	if c.closing {
+		q := &c.writeq[PriorityControl]
+		if len(q.items) > 0 {
+			if err := c.codec.WriteBatch(buf, q.items); err != nil {
+				log.Error(err)
+				buf.Reset()
+			}
+			q.reset()
+		}
 		return true
 	}
-
-	if len(c.writeq) == 0 {
+	if c.closed {
 		return false
 	}
 
-	for _, bs := range c.writeq {
-		writer.Write(bs)
+	limit, _ := c.pending()
+	if c.maxBatch > 0 && limit > c.maxBatch {
+		limit = c.maxBatch
+	}
+	batch := c.batch[:0]
+	for p := range c.writeq {
+		q := &c.writeq[p]
+		n := len(q.items)
+		if n > limit-len(batch) {
+			n = limit - len(batch)
+		}
+		batch = append(batch, q.items[:n]...)
+		q.drop(n)
+	}
+	if len(batch) == 0 {
+		return false
+	}
+	err := c.codec.WriteBatch(buf, batch)
+	for i := range batch {
+		batch[i] = nil
+	}
+	c.batch = batch[:0]
+	if err != nil {
+		// 不发送不完整的帧，丢弃该批消息并关闭连接
+		log.Error(err)
+		buf.Reset()
+		return true
 	}
-	writer.Write(rightSB)
-	c.writeq = c.writeq[:0]
+
+	// 超出最大批量的部分留待下一帧
+	c.schedule()
 	return false
 }
 
+// 发送关闭帧后关闭连接
+func (c *client) closeWith(code int, reason string) {
+	deadline := time.Now().Add(c.sendTimeout)
+	if err := c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline); err != nil {
+		log.Error(err)
+	}
+	_ = c.conn.Close()
+}
+
 func (c *client) send(data []byte) error {
-	log.Debugf("%09d sent Response: %s", time.Now().UnixNano()%int64(time.Second), data)
+	log.Debugf("%09d sent Response: %d bytes", time.Now().UnixNano()%int64(time.Second), len(data))
 	c.sendMu.Lock()
 	defer c.sendMu.Unlock()
 	if c.sendTimeout > 0 {
 		c.conn.SetWriteDeadline(time.Now().Add(c.sendTimeout))
 	}
-	return c.conn.WriteMessage(websocket.TextMessage, data)
+	compress := c.compress && len(data) >= c.svc.opt.compressionMin
+	c.conn.EnableWriteCompression(compress)
+	c.svc.stats.addFrame(len(data), compress)
+	return c.conn.WriteMessage(c.codec.MessageType(), data)
 }
 
 func (c *client) ping() error {
@@ -215,15 +463,13 @@ func (c *client) run() error {
 		}
 	}
 
-	var buf bytes.Buffer
-	en := json.NewEncoder(&buf)
 	for {
-		var reqDatas []*RequestData
 		if c.recvTimeout > 0 {
 			c.conn.SetReadDeadline(time.Now().Add(c.recvTimeout))
 		}
 
-		if err := c.conn.ReadJSON(&reqDatas); err != nil {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
 			if !websocket.IsCloseError(err) || websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				// 意外的错误
 				log.Error(err)
@@ -233,6 +479,12 @@ func (c *client) run() error {
 			return err
 		}
 
+		reqDatas, err := c.codec.DecodeRequests(data)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+
 		for _, reqData := range reqDatas {
 			if reqData == nil {
 				err := errors.New("nil request")
@@ -253,36 +505,59 @@ func (c *client) run() error {
 				},
 			}
 			if err := handler(req, rsp); err != nil {
-				// 发生错误关闭连接
+				// 发生错误关闭连接，关闭前发出带错误码的响应
 				log.Error(err)
+				if rsp.data.Code != 0 {
+					if item, err := c.codec.EncodeResponse(rsp.data); err == nil {
+						c.write(item, writeOptions{priority: PriorityControl})
+					}
+				}
+				c.Close()
 				return err
 			}
 
-			buf.Reset()
-			if err := en.Encode(rsp.data); err != nil {
+			item, err := c.codec.EncodeResponse(rsp.data)
+			if err != nil {
 				log.Error(err)
 				return err
 			}
-			c.write(buf.Bytes(), req.data.Immed)
+			// 回应优先于推送数据，要求立即返回的不等待合批窗口
+			priority := PriorityHigh
+			if req.data.Immed {
+				priority = PriorityControl
+			}
+			c.write(item, writeOptions{priority: priority})
 		}
 	}
 }
 
-func newClient(svc *server, conn *websocket.Conn, recvWait time.Duration, sendWait time.Duration, tcpKeepAlive bool) *client {
+func newClient(svc *server, conn *websocket.Conn, codec Codec, recvWait time.Duration, sendWait time.Duration, tcpKeepAlive bool) *client {
 	if tcpKeepAlive {
-		if sock, ok := conn.UnderlyingConn().(*net.TCPConn); ok {
+		sock_ := conn.UnderlyingConn()
+		if cc, ok := sock_.(*countingConn); ok {
+			sock_ = cc.Conn
+		}
+		if sock, ok := sock_.(*net.TCPConn); ok {
 			sock.SetKeepAlive(true)
 			sock.SetKeepAlivePeriod(recvWait)
 		}
 	}
 
+	if svc.opt.readLimit > 0 {
+		conn.SetReadLimit(svc.opt.readLimit)
+	}
+
 	c := &client{
 		svc:         svc,
 		conn:        conn,
 		ctx:         context.Background(),
+		codec:       codec,
 		closed:      false,
 		recvTimeout: recvWait,
 		sendTimeout: sendWait,
+
+		flushInterval: svc.opt.flushInterval,
+		maxBatch:      svc.opt.maxBatch,
 	}
 	return c
 }
@@ -0,0 +1,246 @@
+package twebsocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack"
+	"io"
+	pb "tpush/internal/twebsocket/proto/twebsocket"
+)
+
+const (
+	CodecJson     = "json"
+	CodecMsgpack  = "msgpack"
+	CodecProtobuf = "protobuf"
+)
+
+// 编解码器，按协商的websocket子协议选择，未协商时使用json
+type Codec interface {
+	// 对应的子协议名
+	Name() string
+	// websocket消息类型，TextMessage或BinaryMessage
+	MessageType() int
+	// 一帧中可以包含多个请求
+	DecodeRequests(data []byte) ([]*RequestData, error)
+	EncodeResponse(rsp *ResponseData) ([]byte, error)
+	// 把多个已编码的响应合并为一帧写入w
+	WriteBatch(w io.Writer, items [][]byte) error
+}
+
+var (
+	leftSB  = []byte("[")
+	rightSB = []byte("]")
+	comma   = []byte(",")
+)
+
+// 帧为JSON数组
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return CodecJson
+}
+
+func (jsonCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) DecodeRequests(data []byte) ([]*RequestData, error) {
+	var reqDatas []*RequestData
+	err := json.Unmarshal(data, &reqDatas)
+	return reqDatas, err
+}
+
+func (jsonCodec) EncodeResponse(rsp *ResponseData) ([]byte, error) {
+	return json.Marshal(rsp)
+}
+
+func (jsonCodec) WriteBatch(w io.Writer, items [][]byte) error {
+	if _, err := w.Write(leftSB); err != nil {
+		return err
+	}
+	for i, item := range items {
+		if i > 0 {
+			if _, err := w.Write(comma); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(item); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(rightSB)
+	return err
+}
+
+func NewJsonCodec() Codec {
+	return jsonCodec{}
+}
+
+// 帧为MessagePack数组，字段名与json相同
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return CodecMsgpack
+}
+
+func (msgpackCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+func (msgpackCodec) DecodeRequests(data []byte) ([]*RequestData, error) {
+	var reqDatas []*RequestData
+	err := msgpack.NewDecoder(bytes.NewReader(data)).UseJSONTag(true).Decode(&reqDatas)
+	return reqDatas, err
+}
+
+func (msgpackCodec) EncodeResponse(rsp *ResponseData) ([]byte, error) {
+	var buf bytes.Buffer
+	err := msgpack.NewEncoder(&buf).UseJSONTag(true).UseCompactEncoding(true).Encode(rsp)
+	return buf.Bytes(), err
+}
+
+func (msgpackCodec) WriteBatch(w io.Writer, items [][]byte) error {
+	if err := msgpack.NewEncoder(w).EncodeArrayLen(len(items)); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if _, err := w.Write(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewMsgpackCodec() Codec {
+	return msgpackCodec{}
+}
+
+// 帧为proto/twebsocket/twebsocket.proto中的Requests/Responses，data为google.protobuf.Value
+type protobufCodec struct{}
+
+// 经json转换为通用结构，数字统一为double
+func toValue(v interface{}) (*structpb.Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var i interface{}
+	if err := json.Unmarshal(bs, &i); err != nil {
+		return nil, err
+	}
+	return newValue(i), nil
+}
+
+func newValue(v interface{}) *structpb.Value {
+	switch v := v.(type) {
+	case bool:
+		return &structpb.Value{Kind: &structpb.Value_BoolValue{BoolValue: v}}
+	case float64:
+		return &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: v}}
+	case string:
+		return &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: v}}
+	case []interface{}:
+		values := make([]*structpb.Value, len(v))
+		for i, e := range v {
+			values[i] = newValue(e)
+		}
+		return &structpb.Value{Kind: &structpb.Value_ListValue{ListValue: &structpb.ListValue{Values: values}}}
+	case map[string]interface{}:
+		fields := make(map[string]*structpb.Value, len(v))
+		for k, e := range v {
+			fields[k] = newValue(e)
+		}
+		return &structpb.Value{Kind: &structpb.Value_StructValue{StructValue: &structpb.Struct{Fields: fields}}}
+	default:
+		return &structpb.Value{Kind: &structpb.Value_NullValue{}}
+	}
+}
+
+func fromValue(v *structpb.Value) interface{} {
+	switch k := v.GetKind().(type) {
+	case *structpb.Value_BoolValue:
+		return k.BoolValue
+	case *structpb.Value_NumberValue:
+		return k.NumberValue
+	case *structpb.Value_StringValue:
+		return k.StringValue
+	case *structpb.Value_ListValue:
+		values := make([]interface{}, len(k.ListValue.GetValues()))
+		for i, e := range k.ListValue.GetValues() {
+			values[i] = fromValue(e)
+		}
+		return values
+	case *structpb.Value_StructValue:
+		fields := make(map[string]interface{}, len(k.StructValue.GetFields()))
+		for name, e := range k.StructValue.GetFields() {
+			fields[name] = fromValue(e)
+		}
+		return fields
+	default:
+		return nil
+	}
+}
+
+func (protobufCodec) Name() string {
+	return CodecProtobuf
+}
+
+func (protobufCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+func (protobufCodec) DecodeRequests(data []byte) ([]*RequestData, error) {
+	var reqs pb.Requests
+	if err := proto.Unmarshal(data, &reqs); err != nil {
+		return nil, err
+	}
+	reqDatas := make([]*RequestData, len(reqs.Items))
+	for i, req := range reqs.Items {
+		reqDatas[i] = &RequestData{
+			Cmd:   req.Cmd,
+			Seq:   req.Seq,
+			Immed: req.Immed,
+			Data:  fromValue(req.Data),
+		}
+	}
+	return reqDatas, nil
+}
+
+func (protobufCodec) EncodeResponse(rsp *ResponseData) ([]byte, error) {
+	data, err := toValue(rsp.Data)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&pb.Response{
+		Cmd:  rsp.Cmd,
+		Seq:  rsp.Seq,
+		Code: rsp.Code,
+		Msg:  rsp.Msg,
+		Data: data,
+	})
+}
+
+// 逐个写入Responses.items(字段1)
+func (protobufCodec) WriteBatch(w io.Writer, items [][]byte) error {
+	buf := proto.NewBuffer(nil)
+	for _, item := range items {
+		if err := buf.EncodeVarint(1<<3 | proto.WireBytes); err != nil {
+			return err
+		}
+		if err := buf.EncodeRawBytes(item); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func NewProtobufCodec() Codec {
+	return protobufCodec{}
+}
@@ -0,0 +1,93 @@
+package twebsocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+const (
+	CodeBadRequest    int32 = -1 // 请求数据解码或校验失败
+	CodeInternalError int32 = -2 // 处理函数panic
+)
+
+// 类型化处理函数返回的错误，Code和Msg写入响应；其他错误直接关闭连接
+type CodeError struct {
+	Code  int32
+	Msg   string
+	Close bool // 发送响应后关闭连接
+}
+
+func (e *CodeError) Error() string {
+	return fmt.Sprintf("%s(%d)", e.Msg, e.Code)
+}
+
+func NewCodeError(code int32, msg string, closeConnection bool) error {
+	return &CodeError{Code: code, Msg: msg, Close: closeConnection}
+}
+
+// 请求数据实现该接口时，解码后调用校验
+type Validator interface {
+	Validate() error
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	clientType  = reflect.TypeOf((*Client)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// handler形如func(ctx context.Context, cli Client, req *Req) (*Rsp, error)，
+// 请求数据解码到新建的Req，返回的Rsp作为响应数据
+func (mux *ServeMux) Handle(cmd string, handler interface{}, mws ...Middleware) {
+	mux.HandleFunc(cmd, typedHandler(cmd, handler), mws...)
+}
+
+func typedHandler(cmd string, handler interface{}) HandlerFunc {
+	fn := reflect.ValueOf(handler)
+	ft := fn.Type()
+	if ft.Kind() != reflect.Func ||
+		ft.NumIn() != 3 || ft.In(0) != contextType || ft.In(1) != clientType || ft.In(2).Kind() != reflect.Ptr ||
+		ft.NumOut() != 2 || ft.Out(1) != errorType {
+		panic(fmt.Sprintf("twebsocket: invalid handler %v for %s", ft, cmd))
+	}
+	reqType := ft.In(2).Elem()
+
+	return func(req Request, rsp Response) error {
+		reqValue := reflect.New(reqType)
+		if err := req.DecodeData(reqValue.Interface()); err != nil {
+			return Error(rsp, CodeBadRequest, err.Error(), false)
+		}
+		if v, ok := reqValue.Interface().(Validator); ok {
+			if err := v.Validate(); err != nil {
+				var ce *CodeError
+				if errors.As(err, &ce) {
+					return Error(rsp, ce.Code, ce.Msg, ce.Close)
+				}
+				return Error(rsp, CodeBadRequest, err.Error(), false)
+			}
+		}
+
+		out := fn.Call([]reflect.Value{reflect.ValueOf(req.Context()), reflect.ValueOf(req.Client()), reqValue})
+		if err, _ := out[1].Interface().(error); err != nil {
+			var ce *CodeError
+			if errors.As(err, &ce) {
+				return Error(rsp, ce.Code, ce.Msg, ce.Close)
+			}
+			return Fatal(rsp, err)
+		}
+
+		var data interface{}
+		switch out[0].Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+			if !out[0].IsNil() {
+				data = out[0].Interface()
+			}
+		default:
+			data = out[0].Interface()
+		}
+		rsp.EncodeData(data, 0, "")
+		return nil
+	}
+}
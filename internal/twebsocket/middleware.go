@@ -0,0 +1,57 @@
+package twebsocket
+
+import (
+	log "github.com/micro/go-micro/v2/logger"
+	"runtime/debug"
+	"time"
+)
+
+// 包装命令处理函数，用于日志、恢复、计时、鉴权、限流等
+type Middleware func(next HandlerFunc) HandlerFunc
+
+func chain(h HandlerFunc, mws []Middleware) HandlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// 捕获处理函数的panic，返回CodeInternalError，不关闭连接
+func Recovery() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req Request, rsp Response) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("panic in handler of %s: %v\n%s", req.Command(), r, debug.Stack())
+					err = Error(rsp, CodeInternalError, "internal error", false)
+				}
+			}()
+			return next(req, rsp)
+		}
+	}
+}
+
+// 记录响应码
+type codeRecorder struct {
+	Response
+	code int32
+}
+
+func (r *codeRecorder) EncodeData(data interface{}, code int32, msg string) {
+	r.code = code
+	r.Response.EncodeData(data, code, msg)
+}
+
+// 按指定级别记录每个命令的序号、响应码、耗时及错误
+func AccessLog(level log.Level) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req Request, rsp Response) error {
+			start := time.Now()
+			rec := &codeRecorder{Response: rsp}
+			err := next(req, rec)
+			log.Logf(level, "cmd: %s, seq: %d, code: %d, cost: %v, err: %v",
+				req.Command(), req.Sequence(), rec.code, time.Since(start), err)
+			return err
+		}
+	}
+}
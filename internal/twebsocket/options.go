@@ -7,6 +7,21 @@ type Options struct {
 	recvTimeout time.Duration
 	sendTimeout time.Duration
 
+	allowedOrigins    []string
+	readBufferSize    int
+	writeBufferSize   int
+	subprotocols      []string
+	readLimit         int64
+	enableCompression bool
+	compressionLevel  int
+	compressionMin    int
+	codecs            []Codec
+	maxQueueMessages  int
+	maxQueueBytes     int
+	overflowPolicy    OverflowPolicy
+	flushInterval     time.Duration
+	maxBatch          int
+
 	upgradeHandler UpgradeHandler
 	openHandler    OpenHandler
 	closeHandler   CloseHandler
@@ -49,3 +64,77 @@ func WithCloseHandler(handler CloseHandler) Option {
 		opt.closeHandler = handler
 	}
 }
+
+// 允许的Origin，可为完整Origin或主机名(不限端口)，支持通配符，如"*.example.com"，为空时允许所有
+func WithAllowedOrigins(origins ...string) Option {
+	return func(opt *Options) {
+		opt.allowedOrigins = origins
+	}
+}
+
+func WithBufferSize(read, write int) Option {
+	return func(opt *Options) {
+		opt.readBufferSize = read
+		opt.writeBufferSize = write
+	}
+}
+
+// 按优先顺序排列的服务端支持的子协议
+func WithSubprotocols(protocols ...string) Option {
+	return func(opt *Options) {
+		opt.subprotocols = protocols
+	}
+}
+
+// 单条消息的最大字节数，超过时关闭连接
+func WithReadLimit(limit int64) Option {
+	return func(opt *Options) {
+		opt.readLimit = limit
+	}
+}
+
+// 启用permessage-deflate压缩
+func WithCompression(enable bool) Option {
+	return func(opt *Options) {
+		opt.enableCompression = enable
+	}
+}
+
+// 压缩级别，参见compress/flate，默认为1(BestSpeed)
+func WithCompressionLevel(level int) Option {
+	return func(opt *Options) {
+		opt.compressionLevel = level
+	}
+}
+
+// 仅压缩不小于minSize字节的消息，过小的消息压缩后收益有限
+func WithCompressionThreshold(minSize int) Option {
+	return func(opt *Options) {
+		opt.compressionMin = minSize
+	}
+}
+
+// 可通过子协议协商的编解码器，按优先顺序排列，默认为json、msgpack及protobuf
+func WithCodecs(codecs ...Codec) Option {
+	return func(opt *Options) {
+		opt.codecs = codecs
+	}
+}
+
+// 每个客户端待发送队列的消息数及字节数上限，0为不限制，超过时按policy处理
+func WithWriteQueueLimit(maxMessages, maxBytes int, policy OverflowPolicy) Option {
+	return func(opt *Options) {
+		opt.maxQueueMessages = maxMessages
+		opt.maxQueueBytes = maxBytes
+		opt.overflowPolicy = policy
+	}
+}
+
+// 合批发送：首条待发送消息到达后最多等待interval，或累积maxBatch条时发送，
+// 每帧最多maxBatch条；均为0时有消息即发送，可通过Client.SetBatching按客户端调整
+func WithBatching(interval time.Duration, maxBatch int) Option {
+	return func(opt *Options) {
+		opt.flushInterval = interval
+		opt.maxBatch = maxBatch
+	}
+}
@@ -1,6 +1,9 @@
 package twebsocket
 
-import "github.com/mitchellh/mapstructure"
+import (
+	"context"
+	"github.com/mitchellh/mapstructure"
+)
 
 func DecodeData(payload interface{}, data interface{}) error {
 	return mapstructure.Decode(payload, data)
@@ -15,6 +18,8 @@ type Request interface {
 	Sequence() int64
 	DecodeData(data interface{}) error
 	Client() Client
+	// 携带客户端上下文中的值
+	Context() context.Context
 }
 
 type Response interface {
@@ -45,6 +50,10 @@ func (req *request) Client() Client {
 	return req.cli
 }
 
+func (req *request) Context() context.Context {
+	return req.cli.ctx
+}
+
 func (req *request) Command() string {
 	return req.data.Cmd
 }
@@ -0,0 +1,267 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: twebsocket.proto
+
+// 子协议为protobuf时的帧格式，客户端发送Requests，服务端发送Responses
+
+package twebsocket
+
+import (
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	_struct "github.com/golang/protobuf/ptypes/struct"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type Request struct {
+	Cmd                  string         `protobuf:"bytes,1,opt,name=cmd,proto3" json:"cmd,omitempty"`
+	Seq                  int64          `protobuf:"varint,2,opt,name=seq,proto3" json:"seq,omitempty"`
+	Immed                bool           `protobuf:"varint,3,opt,name=immed,proto3" json:"immed,omitempty"`
+	Data                 *_struct.Value `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
+	XXX_unrecognized     []byte         `json:"-"`
+	XXX_sizecache        int32          `json:"-"`
+}
+
+func (m *Request) Reset()         { *m = Request{} }
+func (m *Request) String() string { return proto.CompactTextString(m) }
+func (*Request) ProtoMessage()    {}
+func (*Request) Descriptor() ([]byte, []int) {
+	return fileDescriptor_5a31a302eab529f5, []int{0}
+}
+
+func (m *Request) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Request.Unmarshal(m, b)
+}
+func (m *Request) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Request.Marshal(b, m, deterministic)
+}
+func (m *Request) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Request.Merge(m, src)
+}
+func (m *Request) XXX_Size() int {
+	return xxx_messageInfo_Request.Size(m)
+}
+func (m *Request) XXX_DiscardUnknown() {
+	xxx_messageInfo_Request.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Request proto.InternalMessageInfo
+
+func (m *Request) GetCmd() string {
+	if m != nil {
+		return m.Cmd
+	}
+	return ""
+}
+
+func (m *Request) GetSeq() int64 {
+	if m != nil {
+		return m.Seq
+	}
+	return 0
+}
+
+func (m *Request) GetImmed() bool {
+	if m != nil {
+		return m.Immed
+	}
+	return false
+}
+
+func (m *Request) GetData() *_struct.Value {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+type Requests struct {
+	Items                []*Request `protobuf:"bytes,1,rep,name=items,proto3" json:"items,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
+	XXX_unrecognized     []byte     `json:"-"`
+	XXX_sizecache        int32      `json:"-"`
+}
+
+func (m *Requests) Reset()         { *m = Requests{} }
+func (m *Requests) String() string { return proto.CompactTextString(m) }
+func (*Requests) ProtoMessage()    {}
+func (*Requests) Descriptor() ([]byte, []int) {
+	return fileDescriptor_5a31a302eab529f5, []int{1}
+}
+
+func (m *Requests) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Requests.Unmarshal(m, b)
+}
+func (m *Requests) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Requests.Marshal(b, m, deterministic)
+}
+func (m *Requests) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Requests.Merge(m, src)
+}
+func (m *Requests) XXX_Size() int {
+	return xxx_messageInfo_Requests.Size(m)
+}
+func (m *Requests) XXX_DiscardUnknown() {
+	xxx_messageInfo_Requests.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Requests proto.InternalMessageInfo
+
+func (m *Requests) GetItems() []*Request {
+	if m != nil {
+		return m.Items
+	}
+	return nil
+}
+
+type Response struct {
+	Cmd                  string         `protobuf:"bytes,1,opt,name=cmd,proto3" json:"cmd,omitempty"`
+	Seq                  int64          `protobuf:"varint,2,opt,name=seq,proto3" json:"seq,omitempty"`
+	Code                 int32          `protobuf:"varint,3,opt,name=code,proto3" json:"code,omitempty"`
+	Msg                  string         `protobuf:"bytes,4,opt,name=msg,proto3" json:"msg,omitempty"`
+	Data                 *_struct.Value `protobuf:"bytes,5,opt,name=data,proto3" json:"data,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
+	XXX_unrecognized     []byte         `json:"-"`
+	XXX_sizecache        int32          `json:"-"`
+}
+
+func (m *Response) Reset()         { *m = Response{} }
+func (m *Response) String() string { return proto.CompactTextString(m) }
+func (*Response) ProtoMessage()    {}
+func (*Response) Descriptor() ([]byte, []int) {
+	return fileDescriptor_5a31a302eab529f5, []int{2}
+}
+
+func (m *Response) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Response.Unmarshal(m, b)
+}
+func (m *Response) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Response.Marshal(b, m, deterministic)
+}
+func (m *Response) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Response.Merge(m, src)
+}
+func (m *Response) XXX_Size() int {
+	return xxx_messageInfo_Response.Size(m)
+}
+func (m *Response) XXX_DiscardUnknown() {
+	xxx_messageInfo_Response.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Response proto.InternalMessageInfo
+
+func (m *Response) GetCmd() string {
+	if m != nil {
+		return m.Cmd
+	}
+	return ""
+}
+
+func (m *Response) GetSeq() int64 {
+	if m != nil {
+		return m.Seq
+	}
+	return 0
+}
+
+func (m *Response) GetCode() int32 {
+	if m != nil {
+		return m.Code
+	}
+	return 0
+}
+
+func (m *Response) GetMsg() string {
+	if m != nil {
+		return m.Msg
+	}
+	return ""
+}
+
+func (m *Response) GetData() *_struct.Value {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+type Responses struct {
+	Items                []*Response `protobuf:"bytes,1,rep,name=items,proto3" json:"items,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}    `json:"-"`
+	XXX_unrecognized     []byte      `json:"-"`
+	XXX_sizecache        int32       `json:"-"`
+}
+
+func (m *Responses) Reset()         { *m = Responses{} }
+func (m *Responses) String() string { return proto.CompactTextString(m) }
+func (*Responses) ProtoMessage()    {}
+func (*Responses) Descriptor() ([]byte, []int) {
+	return fileDescriptor_5a31a302eab529f5, []int{3}
+}
+
+func (m *Responses) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Responses.Unmarshal(m, b)
+}
+func (m *Responses) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Responses.Marshal(b, m, deterministic)
+}
+func (m *Responses) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Responses.Merge(m, src)
+}
+func (m *Responses) XXX_Size() int {
+	return xxx_messageInfo_Responses.Size(m)
+}
+func (m *Responses) XXX_DiscardUnknown() {
+	xxx_messageInfo_Responses.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Responses proto.InternalMessageInfo
+
+func (m *Responses) GetItems() []*Response {
+	if m != nil {
+		return m.Items
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*Request)(nil), "twebsocket.Request")
+	proto.RegisterType((*Requests)(nil), "twebsocket.Requests")
+	proto.RegisterType((*Response)(nil), "twebsocket.Response")
+	proto.RegisterType((*Responses)(nil), "twebsocket.Responses")
+}
+
+func init() {
+	proto.RegisterFile("twebsocket.proto", fileDescriptor_5a31a302eab529f5)
+}
+
+var fileDescriptor_5a31a302eab529f5 = []byte{
+	// 241 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x8f, 0x3d, 0x4f, 0xc3, 0x30,
+	0x10, 0x86, 0x65, 0x92, 0x40, 0x73, 0x5d, 0x2a, 0x53, 0x21, 0x0b, 0x31, 0x58, 0x99, 0x4c, 0x07,
+	0x57, 0x2a, 0x42, 0xfc, 0x0f, 0x0f, 0xec, 0xf9, 0x38, 0xa2, 0x8a, 0x9a, 0x6b, 0x7b, 0x8e, 0x58,
+	0xf9, 0xe9, 0xc8, 0x4e, 0x0a, 0xed, 0xd6, 0xed, 0xf5, 0xf9, 0xb1, 0xdf, 0xe7, 0x60, 0x11, 0xbe,
+	0xb1, 0x61, 0x6a, 0x3f, 0x31, 0xd8, 0xfd, 0x91, 0x02, 0x49, 0xf8, 0x9f, 0x3c, 0x3e, 0xf5, 0x44,
+	0xfd, 0x0e, 0xd7, 0xe9, 0xa6, 0x19, 0x3e, 0xd6, 0x1c, 0x8e, 0x43, 0x3b, 0x91, 0x15, 0xc1, 0x9d,
+	0xc3, 0xc3, 0x80, 0x1c, 0xe4, 0x02, 0xb2, 0xd6, 0x77, 0x4a, 0x68, 0x61, 0x4a, 0x17, 0x63, 0x9c,
+	0x30, 0x1e, 0xd4, 0x8d, 0x16, 0x26, 0x73, 0x31, 0xca, 0x25, 0x14, 0x5b, 0xef, 0xb1, 0x53, 0x99,
+	0x16, 0x66, 0xe6, 0xc6, 0x83, 0x5c, 0x41, 0xde, 0xd5, 0xa1, 0x56, 0xb9, 0x16, 0x66, 0xbe, 0x79,
+	0xb0, 0x63, 0xa3, 0x3d, 0x35, 0xda, 0xf7, 0x7a, 0x37, 0xa0, 0x4b, 0x4c, 0xf5, 0x0a, 0xb3, 0xa9,
+	0x90, 0xe5, 0x33, 0x14, 0xdb, 0x80, 0x9e, 0x95, 0xd0, 0x99, 0x99, 0x6f, 0xee, 0xed, 0xd9, 0x22,
+	0x13, 0xe4, 0x46, 0xa2, 0xfa, 0x11, 0xf1, 0x1d, 0xef, 0xe9, 0x8b, 0xf1, 0x2a, 0x53, 0x09, 0x79,
+	0x4b, 0x1d, 0x26, 0xd1, 0xc2, 0xa5, 0x1c, 0x29, 0xcf, 0x7d, 0xd2, 0x2c, 0x5d, 0x8c, 0x7f, 0xe6,
+	0xc5, 0x15, 0xe6, 0x6f, 0x50, 0x9e, 0x0c, 0x58, 0xae, 0x2e, 0xd5, 0x97, 0x97, 0xea, 0x23, 0x35,
+	0xb9, 0x37, 0xb7, 0xe9, 0xbb, 0x97, 0xdf, 0x01, 0x00, 0x5d, 0x51, 0x1c, 0xaa, 0xa8, 0x01, 0x00,
+	0x00,
+}
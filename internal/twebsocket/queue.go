@@ -0,0 +1,119 @@
+package twebsocket
+
+import "sync"
+
+// 客户端待发送队列超过上限时的处理方式
+type OverflowPolicy string
+
+const (
+	DropOldest OverflowPolicy = "drop_oldest" // 丢弃最早的消息，默认
+	DropNewest OverflowPolicy = "drop_newest" // 丢弃新写入的消息
+	Disconnect OverflowPolicy = "disconnect"  // 以1008关闭连接
+)
+
+// 消息优先级，同一帧中优先级高的排在前面
+type Priority int
+
+const (
+	PriorityControl Priority = iota // 控制消息，忽略合批窗口及队列上限，关闭连接前发出
+	PriorityHigh                    // 命令的回应
+	PriorityNormal                  // 默认
+	PriorityBulk                    // 频道广播等大量数据，队列溢出时最先丢弃
+
+	numPriorities = int(PriorityBulk) + 1
+)
+
+// 有待发送消息的客户端，每个客户端至多入队一次，长度不超过客户端数
+type readyQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	q    []*client
+}
+
+func (rq *readyQueue) push(c *client) {
+	rq.mu.Lock()
+	rq.q = append(rq.q, c)
+	rq.mu.Unlock()
+	rq.cond.Signal()
+}
+
+func (rq *readyQueue) pop() *client {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+
+	for len(rq.q) == 0 {
+		rq.cond.Wait()
+	}
+	c := rq.q[0]
+	rq.q[0] = nil
+	rq.q = rq.q[1:]
+	return c
+}
+
+func newReadyQueue() *readyQueue {
+	rq := new(readyQueue)
+	rq.cond = sync.NewCond(&rq.mu)
+	return rq
+}
+
+// 单个优先级的待发送队列，元素为已编码的响应
+type writeQueue struct {
+	items [][]byte
+	bytes int
+	head  int            // items[0]的绝对序号
+	keys  map[string]int // 合并key -> 绝对序号，已发送或丢弃的序号小于head
+}
+
+func (q *writeQueue) push(item []byte, key string) {
+	if len(key) != 0 {
+		if q.keys == nil {
+			q.keys = make(map[string]int)
+		}
+		q.keys[key] = q.head + len(q.items)
+	}
+	q.items = append(q.items, item)
+	q.bytes += len(item)
+}
+
+// 替换队列中相同key的消息，返回被替换消息的字节数
+func (q *writeQueue) replace(item []byte, key string) (int, bool) {
+	abs, ok := q.keys[key]
+	if !ok || abs < q.head {
+		return 0, false
+	}
+	i := abs - q.head
+	size := len(q.items[i])
+	q.bytes += len(item) - size
+	q.items[i] = item
+	return size, true
+}
+
+// 移除前n条
+func (q *writeQueue) drop(n int) {
+	for i := 0; i < n; i++ {
+		q.bytes -= len(q.items[i])
+	}
+	q.head += n
+	if n == len(q.items) {
+		for i := range q.items {
+			q.items[i] = nil
+		}
+		q.items = q.items[:0]
+		q.keys = nil
+		return
+	}
+	m := copy(q.items, q.items[n:])
+	// 清除移出的引用，避免底层数组持有已发送的消息
+	for i := m; i < len(q.items); i++ {
+		q.items[i] = nil
+	}
+	q.items = q.items[:m]
+}
+
+// 清空队列并释放底层数组
+func (q *writeQueue) reset() {
+	q.head += len(q.items)
+	q.items = nil
+	q.bytes = 0
+	q.keys = nil
+}
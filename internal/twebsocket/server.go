@@ -2,10 +2,14 @@ package twebsocket
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/gorilla/websocket"
 	log "github.com/micro/go-micro/v2/logger"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,26 +17,37 @@ import (
 type WritePumpHttpHandler interface {
 	http.Handler
 	StartWritePumps(workers int)
+	Stats() Stats
 }
 
 var (
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-
 	defaultServeMux    = newDefaultServeMux()
 	defaultSendTimeout = time.Second * 10
+	defaultBufferSize  = 1024
+
+	defaultCompressionLevel = 1
 )
 
-type UpgradeHandler func(req *http.Request) error
+// 返回的ctx作为客户端的初始上下文，仅使用其中的值；返回错误时拒绝升级
+type UpgradeHandler func(req *http.Request) (ctx context.Context, err error)
 type OpenHandler func(cli Client) error
 type CloseHandler func(cli Client)
 type HandlerFunc func(req Request, rsp Response) error
 
+// 拒绝升级时指定返回的HTTP状态码，其他错误返回403
+type StatusError struct {
+	Code int
+	Err  error
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s(%d)", e.Err, e.Code)
+}
+
+func NewStatusError(code int, err error) error {
+	return &StatusError{Code: code, Err: err}
+}
+
 func Error(rsp Response, code int32, msg string, closeConnection bool) error {
 	rsp.EncodeData(nil, code, msg)
 	if closeConnection {
@@ -55,11 +70,17 @@ func UnsupportedCommandHandler() HandlerFunc {
 }
 
 type ServeMux struct {
-	mu sync.RWMutex
-	m  map[string]HandlerFunc
+	mu  sync.RWMutex
+	m   map[string]HandlerFunc
+	mws []Middleware // 全局中间件，作用于所有命令
+
+	// 加上全局中间件后的处理函数，注册或添加中间件时构建，避免每个请求重新包装
+	chained     map[string]HandlerFunc
+	unsupported HandlerFunc
 }
 
-func (mux *ServeMux) HandleFunc(cmd string, handler HandlerFunc) {
+// mws为该命令的中间件，位于全局中间件内层
+func (mux *ServeMux) HandleFunc(cmd string, handler HandlerFunc, mws ...Middleware) {
 	mux.mu.Lock()
 	defer mux.mu.Unlock()
 
@@ -75,19 +96,35 @@ func (mux *ServeMux) HandleFunc(cmd string, handler HandlerFunc) {
 
 	if mux.m == nil {
 		mux.m = make(map[string]HandlerFunc)
+		mux.chained = make(map[string]HandlerFunc)
+	}
+	mux.m[cmd] = chain(handler, mws)
+	mux.chained[cmd] = chain(mux.m[cmd], mux.mws)
+}
+
+// 按顺序追加全局中间件，先添加的位于外层
+func (mux *ServeMux) Use(mws ...Middleware) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	mux.mws = append(mux.mws, mws...)
+	for cmd, h := range mux.m {
+		mux.chained[cmd] = chain(h, mux.mws)
 	}
-	mux.m[cmd] = handler
+	mux.unsupported = chain(UnsupportedCommandHandler(), mux.mws)
 }
 
 func (mux *ServeMux) Handler(cmd string) (h HandlerFunc) {
 	mux.mu.RLock()
 	defer mux.mu.RUnlock()
 
-	if h, exist := mux.m[cmd]; exist {
+	if h, exist := mux.chained[cmd]; exist {
 		return h
-	} else {
-		return UnsupportedCommandHandler()
 	}
+	if mux.unsupported != nil {
+		return mux.unsupported
+	}
+	return UnsupportedCommandHandler()
 }
 
 func NewServeMux() *ServeMux {
@@ -105,50 +142,133 @@ func newDefaultServeMux() *ServeMux {
 }
 
 type server struct {
-	opt *Options
+	opt      *Options
+	upgrader *websocket.Upgrader
+	codecs   map[string]Codec // 子协议名 -> 编解码器
+	stats    stats
 
-	ready chan *client
+	ready *readyQueue
 
 	mu      sync.Mutex
 	clients map[*client]struct{}
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var ctx context.Context
 	if s.opt.upgradeHandler != nil {
-		if err := s.opt.upgradeHandler(r); err != nil {
+		var err error
+		if ctx, err = s.opt.upgradeHandler(r); err != nil {
 			log.Error(err)
+			code := http.StatusForbidden
+			if e, ok := err.(*StatusError); ok {
+				code = e.Code
+			}
+			http.Error(w, http.StatusText(code), code)
 			return
 		}
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := s.upgrader.Upgrade(&countingResponseWriter{ResponseWriter: w, stats: &s.stats}, r, nil)
 	if err != nil {
 		log.Error(err)
 		return
 	}
-	log.Info("new client has connected", r.Header)
+	log.Info("new client has connected ", r.RemoteAddr)
 
-	cli := newClient(s, conn, s.opt.recvTimeout, s.opt.sendTimeout, false)
+	codec, ok := s.codecs[conn.Subprotocol()]
+	if !ok {
+		codec = s.codecs[CodecJson]
+	}
+	cli := newClient(s, conn, codec, s.opt.recvTimeout, s.opt.sendTimeout, false)
+	if s.opt.enableCompression && offersDeflate(r.Header) {
+		cli.compress = true
+		if err := conn.SetCompressionLevel(s.opt.compressionLevel); err != nil {
+			log.Error(err)
+		}
+	}
+	if ctx != nil {
+		cli.ctx = ctx
+	}
 	s.mu.Lock()
 	s.clients[cli] = struct{}{}
 	s.mu.Unlock()
 	go cli.run()
 }
 
+// 客户端是否提供了permessage-deflate扩展，与upgrader的协商规则一致，检查全部头部值
+// upgrader启用压缩时即为协商结果
+func offersDeflate(header http.Header) bool {
+	for _, v := range header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			if i := strings.IndexByte(ext, ';'); i >= 0 {
+				ext = ext[:i]
+			}
+			if strings.TrimSpace(ext) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 没有Origin头的非浏览器客户端总是允许
+func newOriginChecker(patterns []string) func(r *http.Request) bool {
+	if len(patterns) == 0 {
+		return func(r *http.Request) bool {
+			return true
+		}
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if len(origin) == 0 {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		for _, pattern := range patterns {
+			pattern = strings.ToLower(pattern)
+			if ok, _ := path.Match(pattern, strings.ToLower(origin)); ok {
+				return true
+			}
+			if ok, _ := path.Match(pattern, strings.ToLower(u.Host)); ok {
+				return true
+			}
+			// 主机名模式不限端口
+			if ok, _ := path.Match(pattern, strings.ToLower(u.Hostname())); ok {
+				return true
+			}
+		}
+		log.Errorf("origin not allowed: %s", origin)
+		return false
+	}
+}
+
 func (s *server) writePump() {
 	buf := new(bytes.Buffer)
 	for {
-		select {
-		case cli, ok := <-s.ready:
-			if !ok {
-				return
+		cli := s.ready.pop()
+		buf.Reset()
+		closeAfter := cli.swap(buf)
+		// 队列可能已因断开被清空
+		if buf.Len() > 0 {
+			if err := cli.send(buf.Bytes()); err != nil {
+				// 发送失败的连接不再继续发送，关闭后由读协程清理
+				log.Error(err)
+				closeAfter = true
 			}
-			buf.Reset()
-			cli.swap(buf)
-			cli.send(buf.Bytes())
+		}
+		if closeAfter {
+			_ = cli.conn.Close()
 		}
 	}
 }
 
+func (s *server) Stats() Stats {
+	return s.stats.snapshot()
+}
+
 func (s *server) StartWritePumps(workers int) {
 	for i := 0; i < workers; i++ {
 		go s.writePump()
@@ -156,7 +276,10 @@ func (s *server) StartWritePumps(workers int) {
 }
 
 func Server(opts ...Option) WritePumpHttpHandler {
-	opt := new(Options)
+	opt := &Options{
+		compressionLevel: defaultCompressionLevel,
+		codecs:           []Codec{NewJsonCodec(), NewMsgpackCodec(), NewProtobufCodec()},
+	}
 
 	for _, o := range opts {
 		o(opt)
@@ -168,10 +291,37 @@ func Server(opts ...Option) WritePumpHttpHandler {
 	if opt.sendTimeout == 0 {
 		opt.sendTimeout = defaultSendTimeout
 	}
+	if opt.readBufferSize == 0 {
+		opt.readBufferSize = defaultBufferSize
+	}
+	if opt.writeBufferSize == 0 {
+		opt.writeBufferSize = defaultBufferSize
+	}
+	if opt.overflowPolicy == "" {
+		opt.overflowPolicy = DropOldest
+	}
+
+	// 编解码器的名字同时作为可协商的子协议，json总是可用
+	codecs := map[string]Codec{
+		CodecJson: NewJsonCodec(),
+	}
+	subprotocols := append([]string(nil), opt.subprotocols...)
+	for _, codec := range opt.codecs {
+		codecs[codec.Name()] = codec
+		subprotocols = append(subprotocols, codec.Name())
+	}
 
 	s := &server{
-		opt:     opt,
-		ready:   make(chan *client, 100000),
+		opt:    opt,
+		codecs: codecs,
+		upgrader: &websocket.Upgrader{
+			ReadBufferSize:    opt.readBufferSize,
+			WriteBufferSize:   opt.writeBufferSize,
+			Subprotocols:      subprotocols,
+			EnableCompression: opt.enableCompression,
+			CheckOrigin:       newOriginChecker(opt.allowedOrigins),
+		},
+		ready:   newReadyQueue(),
 		clients: make(map[*client]struct{}),
 	}
 	return s
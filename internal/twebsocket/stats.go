@@ -0,0 +1,104 @@
+package twebsocket
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// 发送统计，用于评估压缩的收益及慢客户端的影响
+type Stats struct {
+	Frames            int64 `json:"frames"`
+	CompressedFrames  int64 `json:"compressed_frames"`
+	PayloadBytes      int64 `json:"payload_bytes"`    // 压缩前的消息字节数
+	WireBytes         int64 `json:"wire_bytes"`       // 实际写入连接的字节数，含握手、帧头及控制帧
+	DroppedMessages   int64 `json:"dropped_messages"` // 待发送队列溢出丢弃的消息数
+	DroppedBytes      int64 `json:"dropped_bytes"`
+	SlowDisconnects   int64 `json:"slow_disconnects"`   // 因队列溢出断开的客户端数
+	ConflatedMessages int64 `json:"conflated_messages"` // 被相同key的新消息替换的消息数
+	ConflatedBytes    int64 `json:"conflated_bytes"`
+}
+
+// 写入字节数与消息字节数之比，小于1说明压缩有收益
+func (s Stats) Ratio() float64 {
+	if s.PayloadBytes == 0 {
+		return 0
+	}
+	return float64(s.WireBytes) / float64(s.PayloadBytes)
+}
+
+type stats struct {
+	frames            int64
+	compressedFrames  int64
+	payloadBytes      int64
+	wireBytes         int64
+	droppedMessages   int64
+	droppedBytes      int64
+	slowDisconnects   int64
+	conflatedMessages int64
+	conflatedBytes    int64
+}
+
+func (s *stats) addFrame(size int, compressed bool) {
+	atomic.AddInt64(&s.frames, 1)
+	atomic.AddInt64(&s.payloadBytes, int64(size))
+	if compressed {
+		atomic.AddInt64(&s.compressedFrames, 1)
+	}
+}
+
+func (s *stats) addDropped(messages, bytes int) {
+	atomic.AddInt64(&s.droppedMessages, int64(messages))
+	atomic.AddInt64(&s.droppedBytes, int64(bytes))
+}
+
+func (s *stats) addConflated(bytes int) {
+	atomic.AddInt64(&s.conflatedMessages, 1)
+	atomic.AddInt64(&s.conflatedBytes, int64(bytes))
+}
+
+func (s *stats) snapshot() Stats {
+	return Stats{
+		Frames:            atomic.LoadInt64(&s.frames),
+		CompressedFrames:  atomic.LoadInt64(&s.compressedFrames),
+		PayloadBytes:      atomic.LoadInt64(&s.payloadBytes),
+		WireBytes:         atomic.LoadInt64(&s.wireBytes),
+		DroppedMessages:   atomic.LoadInt64(&s.droppedMessages),
+		DroppedBytes:      atomic.LoadInt64(&s.droppedBytes),
+		SlowDisconnects:   atomic.LoadInt64(&s.slowDisconnects),
+		ConflatedMessages: atomic.LoadInt64(&s.conflatedMessages),
+		ConflatedBytes:    atomic.LoadInt64(&s.conflatedBytes),
+	}
+}
+
+// 统计写入底层连接的字节数
+type countingConn struct {
+	net.Conn
+	stats *stats
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.stats.wireBytes, int64(n))
+	return n, err
+}
+
+// 升级时接管连接，替换为countingConn
+type countingResponseWriter struct {
+	http.ResponseWriter
+	stats *stats
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{Conn: conn, stats: w.stats}, brw, nil
+}
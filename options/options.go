@@ -5,6 +5,38 @@ type RedisOptions struct {
 	Password string
 }
 
+const (
+	StoreEtcd   = "etcd"
+	StoreRedis  = "redis"
+	StoreStatic = "static" // 仅web/route，固定节点列表
+
+	ModeRoute  = "route"  // 查询节点后逐个调用
+	ModeBroker = "broker" // 经broker广播到所有节点
+
+	AuthNone     = "none"
+	AuthHmac     = "hmac"
+	AuthJwtHS256 = "jwt_hs256"
+	AuthJwtRS256 = "jwt_rs256"
+)
+
 var (
 	EtcdAddress = "10.8.9.100:52379"
+
+	RedisAddress  = "10.8.9.100:6379"
+	RedisPassword = ""
+
+	// 分布式注册存储，etcd、redis或static
+	DistributeStore = StoreEtcd
+
+	// 分布式推送模式，route或broker
+	DistributeMode = ModeRoute
+
+	// 广播模式下推送消息的主题
+	PushTopic = "tpush.srv.push"
+
+	// 登录认证方式，none、hmac、jwt_hs256或jwt_rs256
+	AuthType = AuthNone
+
+	// hmac及jwt_hs256为密钥文件，jwt_rs256为PEM格式的公钥文件
+	AuthKeyFile = ""
 )
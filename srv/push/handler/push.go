@@ -50,34 +50,49 @@ func (h *Push) PingPong(ctx context.Context, stream push.Push_PingPongStream) er
 	}
 }
 
+func decodeData(data []byte, datastr string, output interface{}) error {
+	var buf *bytes.Buffer
+	if data != nil {
+		buf = bytes.NewBuffer(data)
+	} else {
+		buf = bytes.NewBufferString(datastr)
+	}
+	return json.NewDecoder(buf).Decode(output)
+}
+
+func deliveryStats(ds []*tchatroom.Delivery) *push.DeliveryStats {
+	stats := &push.DeliveryStats{
+		Targets: make([]*push.TargetStats, len(ds)),
+	}
+	for i, d := range ds {
+		stats.Targets[i] = &push.TargetStats{
+			Target:   d.Target,
+			Matched:  int32(d.Matched),
+			Enqueued: int32(d.Enqueued),
+			Dropped:  int32(d.Dropped),
+		}
+		stats.Matched += int32(d.Matched)
+		stats.Enqueued += int32(d.Enqueued)
+		stats.Dropped += int32(d.Dropped)
+		if d.Matched == 0 {
+			stats.NotFound++
+		}
+	}
+	return stats
+}
+
 func (h *Push) SendToClient(ctx context.Context, req *push.SendToClientReq, rsp *push.SendToClientRsp) error {
 	data := &tchatroom.RecvDataRsp{
 		Id:   req.Id,
 		Uid:  req.Uid,
 		Chan: "",
+		Key:  req.Key,
 	}
-
-	var buf *bytes.Buffer
-	if req.Data != nil {
-		buf = bytes.NewBuffer(req.Data)
-	} else {
-		buf = bytes.NewBufferString(req.Datastr)
-	}
-	if err := json.NewDecoder(buf).Decode(&data.Data); err != nil {
+	if err := decodeData(req.Data, req.Datastr, &data.Data); err != nil {
 		return errors.InternalServerError("push.Push.SendToClient", err.Error())
 	}
 
-	if len(req.Ids) == 1 {
-		cli, ok := h.Room.Client(req.Ids[0])
-		if !ok {
-			return errors.InternalServerError("push.Push.SendToClient", "dest client not found")
-		}
-		go cli.Write(tchatroom.CmdRecvData, 0, data, 0, "", false)
-	} else {
-		cligrp := h.Room.Clients(req.Ids)
-		go cligrp.Write(tchatroom.CmdRecvData, 0, data, 0, "", false)
-	}
-
+	rsp.Stats = deliveryStats(h.Room.SendToClients(req.Ids, data, req.Wait))
 	return nil
 }
 
@@ -88,29 +103,13 @@ func (h *Push) SendToUser(ctx context.Context, req *push.SendToUserReq, rsp *pus
 		Id:   req.Id,
 		Uid:  req.Uid,
 		Chan: "",
+		Key:  req.Key,
 	}
-
-	var buf *bytes.Buffer
-	if req.Data != nil {
-		buf = bytes.NewBuffer(req.Data)
-	} else {
-		buf = bytes.NewBufferString(req.Datastr)
-	}
-	if err := json.NewDecoder(buf).Decode(&data.Data); err != nil {
+	if err := decodeData(req.Data, req.Datastr, &data.Data); err != nil {
 		return errors.InternalServerError("push.Push.SendToUser", err.Error())
 	}
 
-	if len(req.Uids) == 1 {
-		cli, ok := h.Room.ClientsOfUser(req.Uids[0])
-		if !ok {
-			return errors.InternalServerError("push.Push.SendToUser", "dest user not found")
-		}
-		go cli.Write(tchatroom.CmdRecvData, 0, data, 0, "", false)
-	} else {
-		cligrp := h.Room.ClientsOfUsers(req.Uids)
-		go cligrp.Write(tchatroom.CmdRecvData, 0, data, 0, "", false)
-	}
-
+	rsp.Stats = deliveryStats(h.Room.SendToUsers(req.Uids, data, req.Wait))
 	return nil
 }
 
@@ -118,36 +117,63 @@ func (h *Push) SendToChannel(ctx context.Context, req *push.SendToChannelReq, rs
 	data := &tchatroom.RecvDataRsp{
 		Id:  req.Id,
 		Uid: req.Uid,
+		Key: req.Key,
 	}
-
-	var buf *bytes.Buffer
-	if req.Data != nil {
-		buf = bytes.NewBuffer(req.Data)
-	} else {
-		buf = bytes.NewBufferString(req.Datastr)
-	}
-	if err := json.NewDecoder(buf).Decode(&data.Data); err != nil {
+	if err := decodeData(req.Data, req.Datastr, &data.Data); err != nil {
 		return errors.InternalServerError("push.Push.SendToChannel", err.Error())
 	}
 
-	if len(req.Chans) == 1 {
-		data.Chan = req.Chans[0]
-		cli, ok := h.Room.ClientsInChannel(req.Chans[0])
-		if !ok {
-			return errors.InternalServerError("push.Push.SendToChannel", "dest channel not found")
+	rsp.Stats = deliveryStats(h.Room.SendToChannels(req.Chans, data, req.Wait))
+	return nil
+}
+
+func (h *Push) IsOnline(ctx context.Context, req *push.IsOnlineReq, rsp *push.IsOnlineRsp) error {
+	rsp.Online = h.Room.OnlineUsers(req.Uids)
+	return nil
+}
+
+func (h *Push) ListClientsOfUser(ctx context.Context, req *push.ListClientsOfUserReq, rsp *push.ListClientsOfUserRsp) error {
+	rsp.Ids = h.Room.ClientIdsOfUser(req.Uid)
+	return nil
+}
+
+func (h *Push) ListChannelMembers(ctx context.Context, req *push.ListChannelMembersReq, rsp *push.ListChannelMembersRsp) error {
+	members := h.Room.ChannelMembers(req.Chan)
+	rsp.Members = make([]*push.ClientInfo, len(members))
+	for i, m := range members {
+		rsp.Members[i] = &push.ClientInfo{
+			Id:  m.Id,
+			Uid: m.Uid,
 		}
-		go cli.Write(tchatroom.CmdRecvData, 0, data, 0, "", false)
-	} else {
-		go func() {
-			for _, ch := range req.Chans {
-				cligrp, ok := h.Room.ClientsInChannel(ch)
-				if ok {
-					data.Chan = ch
-					cligrp.Write(tchatroom.CmdRecvData, 0, data, 0, "", false)
-				}
-			}
-		}()
 	}
+	return nil
+}
+
+func (h *Push) ChannelsOfClient(ctx context.Context, req *push.ChannelsOfClientReq, rsp *push.ChannelsOfClientRsp) error {
+	rsp.Chans, _ = h.Room.ChannelsOfClient(req.Id)
+	return nil
+}
+
+func (h *Push) CountOnline(ctx context.Context, req *push.CountOnlineReq, rsp *push.CountOnlineRsp) error {
+	clients, users := h.Room.CountOnline()
+	rsp.Clients = int64(clients)
+	rsp.Users = int64(users)
+	return nil
+}
+
+func (h *Push) SubscribeUser(ctx context.Context, req *push.SubscribeUserReq, rsp *push.SubscribeUserRsp) error {
+	clients, err := h.Room.SubscribeUser(req.Uids, req.Chans, req.Persist)
+	rsp.Clients = int32(clients)
+	return err
+}
+
+func (h *Push) UnsubscribeUser(ctx context.Context, req *push.UnsubscribeUserReq, rsp *push.UnsubscribeUserRsp) error {
+	clients, err := h.Room.UnsubscribeUser(req.Uids, req.Chans)
+	rsp.Clients = int32(clients)
+	return err
+}
 
+func (h *Push) Kick(ctx context.Context, req *push.KickReq, rsp *push.KickRsp) error {
+	rsp.Clients = int32(h.Room.Kick(req.Ids, req.Uids, req.Chans, req.Code, req.Reason))
 	return nil
 }
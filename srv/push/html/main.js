@@ -114,6 +114,9 @@ window.addEventListener("load", function(evt) {
           case "rcvdata":
             print('<span style="color: blue;">['+rsp.data.id+':'+rsp.data.uid+':'+rsp.data.chan+'] '+rsp.data.data+'</span>');
             break;
+          case "notice":
+            print('<span style="color: red;">Notice['+rsp.data.type+':'+rsp.data.code+'] '+(rsp.data.reason || '')+'</span>');
+            break;
           case "ping":
             //print('<span style="color: blue;">Ping</span>');
             break;
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/coreos/etcd/clientv3"
 	"github.com/micro/cli/v2"
 	"github.com/micro/go-micro/v2"
 	log "github.com/micro/go-micro/v2/logger"
+	"io/ioutil"
 	_ "net/http/pprof"
 	"time"
+	"tpush/internal"
 	"tpush/internal/tchatroom"
+	"tpush/internal/twebsocket"
 	"tpush/options"
 	"tpush/srv/push/handler"
 	push "tpush/srv/push/proto/push"
@@ -39,6 +43,12 @@ func main() {
 				EnvVars: []string{"LOGIN_TIMEOUT"},
 				Value:   float64(tchatroom.LoginTimeout / time.Second),
 			},
+			&cli.StringFlag{
+				Name:    "admin_address",
+				Usage:   "Set the admin server address of stats and pprof, disabled if empty",
+				EnvVars: []string{"ADMIN_ADDRESS"},
+				Value:   tchatroom.AdminAddress,
+			},
 			&cli.StringFlag{
 				Name:    "stream_pattern",
 				Usage:   "Set the web server stream pattern",
@@ -57,11 +67,138 @@ func main() {
 				EnvVars: []string{"ENABLE_DISTRIBUTE"},
 				Value:   false,
 			},
+			&cli.StringFlag{
+				Name:    "distribute_store",
+				Usage:   "Set the distribute store(etcd|redis)",
+				EnvVars: []string{"DISTRIBUTE_STORE"},
+				Value:   options.DistributeStore,
+			},
+			&cli.StringFlag{
+				Name:    "etcd_address",
+				Usage:   "Set the etcd address of distribute store",
+				EnvVars: []string{"ETCD_ADDRESS"},
+				Value:   options.EtcdAddress,
+			},
+			&cli.StringFlag{
+				Name:    "redis_address",
+				Usage:   "Set the redis address of distribute store",
+				EnvVars: []string{"REDIS_ADDRESS"},
+				Value:   options.RedisAddress,
+			},
+			&cli.StringFlag{
+				Name:    "redis_password",
+				Usage:   "Set the redis password of distribute store",
+				EnvVars: []string{"REDIS_PASSWORD"},
+				Value:   options.RedisPassword,
+			},
+			&cli.StringFlag{
+				Name:    "auth_type",
+				Usage:   "Set the login authentication type(none|hmac|jwt_hs256|jwt_rs256)",
+				EnvVars: []string{"AUTH_TYPE"},
+				Value:   options.AuthType,
+			},
+			&cli.StringFlag{
+				Name:    "auth_key_file",
+				Usage:   "Set the key file of login authentication",
+				EnvVars: []string{"AUTH_KEY_FILE"},
+				Value:   options.AuthKeyFile,
+			},
+			&cli.BoolFlag{
+				Name:    "require_upgrade_auth",
+				Usage:   "reject websocket upgrade without valid token, which is carried by Authorization header(preferred), cookie or query string",
+				EnvVars: []string{"REQUIRE_UPGRADE_AUTH"},
+				Value:   false,
+			},
+			&cli.StringSliceFlag{
+				Name:    "allowed_origins",
+				Usage:   "Set the allowed websocket origins, wildcard supported, allow all if empty",
+				EnvVars: []string{"ALLOWED_ORIGINS"},
+			},
+			&cli.IntFlag{
+				Name:    "ws_read_buffer_size",
+				Usage:   "Set the websocket read buffer size",
+				EnvVars: []string{"WS_READ_BUFFER_SIZE"},
+				Value:   1024,
+			},
+			&cli.IntFlag{
+				Name:    "ws_write_buffer_size",
+				Usage:   "Set the websocket write buffer size",
+				EnvVars: []string{"WS_WRITE_BUFFER_SIZE"},
+				Value:   1024,
+			},
+			&cli.StringSliceFlag{
+				Name:    "ws_subprotocols",
+				Usage:   "Set the supported websocket subprotocols in order of preference",
+				EnvVars: []string{"WS_SUBPROTOCOLS"},
+			},
+			&cli.Int64Flag{
+				Name:    "ws_read_limit",
+				Usage:   "Set the max websocket message size, no limit if zero",
+				EnvVars: []string{"WS_READ_LIMIT"},
+				Value:   0,
+			},
+			&cli.BoolFlag{
+				Name:    "ws_enable_compression",
+				Usage:   "enable websocket permessage-deflate compression",
+				EnvVars: []string{"WS_ENABLE_COMPRESSION"},
+				Value:   false,
+			},
+			&cli.IntFlag{
+				Name:    "ws_compression_level",
+				Usage:   "Set the websocket compression level(-2~9)",
+				EnvVars: []string{"WS_COMPRESSION_LEVEL"},
+				Value:   1,
+			},
+			&cli.IntFlag{
+				Name:    "ws_compression_threshold",
+				Usage:   "Set the min message size to compress",
+				EnvVars: []string{"WS_COMPRESSION_THRESHOLD"},
+				Value:   0,
+			},
+			&cli.IntFlag{
+				Name:    "ws_write_queue_max_messages",
+				Usage:   "Set the max pending messages per client, no limit if zero",
+				EnvVars: []string{"WS_WRITE_QUEUE_MAX_MESSAGES"},
+				Value:   0,
+			},
+			&cli.IntFlag{
+				Name:    "ws_write_queue_max_bytes",
+				Usage:   "Set the max pending bytes per client, no limit if zero",
+				EnvVars: []string{"WS_WRITE_QUEUE_MAX_BYTES"},
+				Value:   0,
+			},
+			&cli.StringFlag{
+				Name:    "ws_write_queue_policy",
+				Usage:   "Set the policy when the client write queue is full(drop_oldest|drop_newest|disconnect)",
+				EnvVars: []string{"WS_WRITE_QUEUE_POLICY"},
+				Value:   string(twebsocket.DropOldest),
+			},
+			&cli.IntFlag{
+				Name:    "ws_flush_interval",
+				Usage:   "Set the push batching window(milliseconds), send immediately if zero",
+				EnvVars: []string{"WS_FLUSH_INTERVAL"},
+				Value:   0,
+			},
+			&cli.IntFlag{
+				Name:    "ws_max_batch",
+				Usage:   "Set the max messages per frame, no limit if zero",
+				EnvVars: []string{"WS_MAX_BATCH"},
+				Value:   0,
+			},
+			&cli.Int64Flag{
+				Name:    "node_id",
+				Usage:   "Set the snowflake node id(0~1023) of client id generator, must be unique in the cluster, derived from server id if negative",
+				EnvVars: []string{"NODE_ID"},
+				Value:   -1,
+			},
 		),
 	)
 
 	var loglevel log.Level
 	var enable_distribute bool
+	var node_id int64
+	var require_upgrade_auth bool
+	wsOpts := make([]twebsocket.Option, 0)
 	// Initialise service
 	service.Init(
 		micro.Action(func(c *cli.Context) error {
@@ -77,6 +214,8 @@ func main() {
 				tchatroom.LoginTimeout = time.Duration(float64(time.Second) * c.Float64("login_timeout"))
 			}
 
+			tchatroom.AdminAddress = c.String("admin_address")
+
 			if f := c.String("stream_pattern"); len(f) > 0 {
 				tchatroom.StreamPattern = f
 			}
@@ -89,6 +228,71 @@ func main() {
 				enable_distribute = c.Bool("enable_distribute")
 			}
 
+			if f := c.String("distribute_store"); len(f) > 0 {
+				options.DistributeStore = f
+			}
+
+			if f := c.String("etcd_address"); len(f) > 0 {
+				options.EtcdAddress = f
+			}
+
+			if f := c.String("redis_address"); len(f) > 0 {
+				options.RedisAddress = f
+			}
+
+			options.RedisPassword = c.String("redis_password")
+
+			if f := c.String("auth_type"); len(f) > 0 {
+				options.AuthType = f
+			}
+
+			if f := c.String("auth_key_file"); len(f) > 0 {
+				options.AuthKeyFile = f
+			}
+
+			if f := c.String("require_upgrade_auth"); len(f) > 0 {
+				require_upgrade_auth = c.Bool("require_upgrade_auth")
+			}
+
+			if f := c.StringSlice("allowed_origins"); len(f) > 0 {
+				wsOpts = append(wsOpts, twebsocket.WithAllowedOrigins(f...))
+			}
+
+			wsOpts = append(wsOpts, twebsocket.WithBufferSize(c.Int("ws_read_buffer_size"), c.Int("ws_write_buffer_size")))
+
+			if f := c.StringSlice("ws_subprotocols"); len(f) > 0 {
+				wsOpts = append(wsOpts, twebsocket.WithSubprotocols(f...))
+			}
+
+			if f := c.Int64("ws_read_limit"); f > 0 {
+				wsOpts = append(wsOpts, twebsocket.WithReadLimit(f))
+			}
+
+			wsOpts = append(wsOpts,
+				twebsocket.WithCompression(c.Bool("ws_enable_compression")),
+				twebsocket.WithCompressionLevel(c.Int("ws_compression_level")),
+				twebsocket.WithCompressionThreshold(c.Int("ws_compression_threshold")),
+			)
+
+			policy := twebsocket.OverflowPolicy(c.String("ws_write_queue_policy"))
+			switch policy {
+			case twebsocket.DropOldest, twebsocket.DropNewest, twebsocket.Disconnect:
+			default:
+				return fmt.Errorf("unsupported write queue policy: %s", policy)
+			}
+			wsOpts = append(wsOpts, twebsocket.WithWriteQueueLimit(
+				c.Int("ws_write_queue_max_messages"), c.Int("ws_write_queue_max_bytes"), policy))
+
+			wsOpts = append(wsOpts, twebsocket.WithBatching(
+				time.Duration(c.Int("ws_flush_interval"))*time.Millisecond, c.Int("ws_max_batch")))
+
+			if f := c.String("node_id"); len(f) > 0 {
+				node_id = c.Int64("node_id")
+			}
+			if node_id > tchatroom.SnowflakeMaxNode {
+				return fmt.Errorf("node_id is out of range(0~%d): %d", tchatroom.SnowflakeMaxNode, node_id)
+			}
+
 			return nil
 		}),
 	)
@@ -101,24 +305,96 @@ func main() {
 	}
 
 	// websocket service
-	opts := make([]tchatroom.Option, 0)
+	opts := []tchatroom.Option{
+		tchatroom.WithWebsocketOptions(wsOpts...),
+	}
 	if enable_distribute {
-		storeAddress := options.EtcdAddress
-		cfg := clientv3.Config{
-			Endpoints: []string{storeAddress},
+		o := service.Server().Options()
+		nodeId := fmt.Sprintf("%s-%s", o.Name, o.Id)
+
+		var d tchatroom.Distribute
+		var claimer tchatroom.NodeIdClaimer
+		switch options.DistributeStore {
+		case options.StoreEtcd:
+			cfg := clientv3.Config{
+				Endpoints: []string{options.EtcdAddress},
+			}
+			c, err := clientv3.New(cfg)
+			if err != nil {
+				log.Fatal(err)
+				return
+			}
+			d = tchatroom.NewEtcdDistribute(nodeId, c, time.Second*30)
+			claimer = tchatroom.NewEtcdNodeIdClaimer(nodeId, c, time.Second*30)
+			opts = append(opts, tchatroom.WithSubscriptionStore(tchatroom.NewEtcdSubscriptionStore(c)))
+		case options.StoreRedis:
+			c := internal.NewCache(options.RedisOptions{
+				Address:  options.RedisAddress,
+				Password: options.RedisPassword,
+			})
+			d = tchatroom.NewRedisDistribute(nodeId, c, time.Second*30)
+			claimer = tchatroom.NewRedisNodeIdClaimer(nodeId, c, time.Second*30)
+			opts = append(opts, tchatroom.WithSubscriptionStore(tchatroom.NewRedisSubscriptionStore(c)))
+		default:
+			log.Fatalf("unsupported distribute store: %s", options.DistributeStore)
+			return
 		}
-		c, err := clientv3.New(cfg)
+		d.Run()
+
+		opts = append(opts, tchatroom.WithDistribute(d))
+
+		// 分布式下客户端标识需集群唯一
+		// 未指定节点号时由server id推导，已被占用则顺延；指定时被占用则退出
+		strict := node_id >= 0
+		if !strict {
+			node_id = tchatroom.SnowflakeNode(o.Id)
+		}
+		node, err := tchatroom.ClaimSnowflakeNode(claimer, node_id, strict)
 		if err != nil {
 			log.Fatal(err)
 			return
 		}
+		claimer.Run()
 
-		o := service.Server().Options()
-		nodeId := fmt.Sprintf("%s-%s", o.Name, o.Id)
-		d := tchatroom.NewEtcdDistribute(nodeId, c, time.Second*30)
-		d.Run()
+		log.Infof("Snowflake node id: %d", node)
+		opts = append(opts, tchatroom.WithIdGenerator(tchatroom.NewSnowflakeIdGenerator(node)))
+	}
 
-		opts = append(opts, tchatroom.WithDistribute(d))
+	var auth tchatroom.Authenticator
+	switch options.AuthType {
+	case options.AuthNone:
+	case options.AuthHmac:
+		secret, err := ioutil.ReadFile(options.AuthKeyFile)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		a, err := tchatroom.NewHmacAuthenticator(bytes.TrimRight(secret, "\r\n"))
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		auth = a
+	case options.AuthJwtHS256:
+		a, err := tchatroom.NewJwtHS256Authenticator(options.AuthKeyFile)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		auth = a
+	case options.AuthJwtRS256:
+		a, err := tchatroom.NewJwtRS256Authenticator(options.AuthKeyFile)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+		auth = a
+	default:
+		log.Fatalf("unsupported auth type: %s", options.AuthType)
+		return
+	}
+	if auth != nil {
+		opts = append(opts, tchatroom.WithAuthenticator(auth), tchatroom.WithUpgradeAuth(require_upgrade_auth))
 	}
 
 	service2 := tchatroom.NewService(opts...)
@@ -142,8 +418,11 @@ func main() {
 	push.RegisterPushHandler(service.Server(), h)
 
 	// Register Struct as Subscriber
-	sub := &subscriber.Push{}
-	micro.RegisterSubscriber("tpush.srv.push", service.Server(), sub)
+	// 不设置队列，每个节点都会收到广播模式的推送消息
+	sub := &subscriber.Push{
+		Room: service2.Room,
+	}
+	micro.RegisterSubscriber(options.PushTopic, service.Server(), sub)
 
 	serviceDone := make(chan struct{})
 
@@ -2,19 +2,38 @@ package subscriber
 
 import (
 	"context"
+	"encoding/json"
+	"github.com/micro/go-micro/v2/errors"
 	log "github.com/micro/go-micro/v2/logger"
+	"tpush/internal/tchatroom"
 
 	push "tpush/srv/push/proto/push"
 )
 
-type Push struct{}
-
-func (e *Push) Handle(ctx context.Context, msg *push.Message) error {
-	log.Info("Handler Received message: ", msg.Say)
-	return nil
+// 广播模式下每个节点都会收到推送消息，仅投递给本节点上的客户端
+type Push struct {
+	Room *tchatroom.Room
 }
 
-func Handler(ctx context.Context, msg *push.Message) error {
-	log.Info("Function Received message: ", msg.Say)
+func (e *Push) Handle(ctx context.Context, msg *push.PushEnvelope) error {
+	data := &tchatroom.RecvDataRsp{
+		Id:  msg.Id,
+		Uid: msg.Uid,
+		Key: msg.Key,
+	}
+	if err := json.Unmarshal(msg.Data, &data.Data); err != nil {
+		return errors.BadRequest("push.Push.Handle", err.Error())
+	}
+
+	switch msg.Type {
+	case push.TargetType_TARGET_CLIENT:
+		e.Room.SendToClients(msg.Ids, data, true)
+	case push.TargetType_TARGET_USER:
+		e.Room.SendToUsers(msg.Uids, data, true)
+	case push.TargetType_TARGET_CHANNEL:
+		e.Room.SendToChannels(msg.Chans, data, true)
+	default:
+		log.Errorf("unsupported target type: %v", msg.Type)
+	}
 	return nil
 }
@@ -3,171 +3,328 @@ package handler
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"github.com/coreos/etcd/clientv3"
+	"github.com/micro/go-micro/v2"
 	"github.com/micro/go-micro/v2/client"
 	"github.com/micro/go-micro/v2/client/grpc"
 	log "github.com/micro/go-micro/v2/logger"
+	"github.com/micro/go-micro/v2/registry"
 	"net/http"
+	"sort"
+	"sync"
 	"time"
-	"tpush/internal"
-	"tpush/internal/tchatroom"
 	push "tpush/srv/push/proto/push"
+	"tpush/web/route/locator"
 	route "tpush/web/route/proto"
 	"tpush/web/route/wrapper"
 )
 
+const (
+	pushServiceName = "tpush.srv.push"
+)
+
 var (
 	clientWrapper = wrapper.NewClientWrapper()
+	callTimeout   = time.Millisecond * 1000
 )
 
 type Handler struct {
-	Etcd    *clientv3.Client
-	PushCli push.PushService
+	Locator   locator.Locator
+	PushCli   push.PushService
+	Publisher micro.Event       // 非空时为广播模式，推送消息经broker发送给所有节点
+	Registry  registry.Registry // 查询push服务的全部节点，为空时使用默认registry
 }
 
-func (h *Handler) SendToUser(w http.ResponseWriter, r *http.Request) {
-	var req route.SendToUserReq
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+func (h *Handler) distributed() bool {
+	return h.Locator != nil || h.Publisher != nil
+}
+
+// push服务当前的全部节点
+func (h *Handler) allNodes() []string {
+	reg := h.Registry
+	if reg == nil {
+		reg = registry.DefaultRegistry
+	}
+	services, err := reg.GetService(pushServiceName)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	var nodes []string
+	for _, service := range services {
+		for _, node := range service.Nodes {
+			nodes = append(nodes, node.Id)
+		}
 	}
+	return nodes
+}
+
+// 查询目标所在的节点，广播模式下没有定位信息，查询全部节点
+func (h *Handler) locate(f func(loc locator.Locator) []string) []string {
+	if !h.distributed() {
+		return nil
+	}
+	if h.Locator == nil {
+		return h.allNodes()
+	}
+	return f(h.Locator)
+}
 
+func (h *Handler) pushCli() push.PushService {
 	if h.PushCli == nil {
 		opts := make([]client.Option, 0)
-		if h.Etcd != nil {
+		if h.distributed() {
 			opts = append(opts, client.Wrap(clientWrapper))
 		}
 		cli := grpc.NewClient(opts...)
-		h.PushCli = push.NewPushService("tpush.srv.push", cli)
+		h.PushCli = push.NewPushService(pushServiceName, cli)
 	}
+	return h.PushCli
+}
 
-	if h.Etcd == nil {
-		data, err := json.Marshal(req.Data)
-		if err != nil {
-			log.Error(err)
-			return
-		}
+// 非分布式时由客户端负载均衡选择节点；分布式时并发调用每个节点
+// wait为true时全部返回后结束并返回调用失败的节点，否则立即返回。返回true表示调用均已完成
+func (h *Handler) call(nodes []string, wait bool, f func(ctx context.Context) error) (done bool, failed []string) {
+	if h.distributed() {
+		log.Infof("Nodes: %#v", nodes)
+	} else {
+		nodes = []string{pushServiceName}
+	}
 
-		pushReq := &push.SendToUserReq{
-			Uids: req.Uids,
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, id := range nodes {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+			defer cancel()
+			if h.distributed() {
+				ctx = context.WithValue(ctx, wrapper.SelectNodeKey{}, id)
+			}
+			if err := f(ctx); err != nil {
+				log.Errorf("call %s err, %v", id, err)
+				mu.Lock()
+				failed = append(failed, id)
+				mu.Unlock()
+			}
+		}(id)
+	}
+	if !wait {
+		return false, nil
+	}
+	wg.Wait()
+	sort.Strings(failed)
+	return true, failed
+}
+
+func (h *Handler) publish(env *push.PushEnvelope) {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	log.Infof("Publish %v", env.Type)
+	if err := h.Publisher.Publish(ctx, env); err != nil {
+		log.Error(err)
+	}
+}
+
+func (h *Handler) SendToClient(w http.ResponseWriter, r *http.Request) {
+	var req route.SendToClientReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	req.Ids = uniqueInt64s(req.Ids)
+
+	data, err := json.Marshal(req.Data)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if h.Publisher != nil {
+		h.publish(&push.PushEnvelope{
+			Type: push.TargetType_TARGET_CLIENT,
+			Ids:  req.Ids,
 			Data: data,
 			Id:   req.Id,
 			Uid:  req.Uid,
+			Key:  req.Key,
+		})
+		if err := json.NewEncoder(w).Encode(&route.SendToRsp{}); err != nil {
+			http.Error(w, err.Error(), 500)
 		}
-		log.Info("SendMsgToUser")
-		ctx, _ := context.WithTimeout(context.Background(), time.Millisecond*1000)
-		_, err = h.PushCli.SendToUser(ctx, pushReq)
+		return
+	}
+
+	pushReq := &push.SendToClientReq{
+		Ids:  req.Ids,
+		Data: data,
+		Id:   req.Id,
+		Uid:  req.Uid,
+		Wait: req.Wait,
+		Key:  req.Key,
+	}
+
+	var nodes []string
+	if h.distributed() {
+		nodes = h.Locator.Clients(req.Ids)
+	}
+	agg := newStatsAggregator(int64Targets(req.Ids))
+	cli := h.pushCli()
+	done, failed := h.call(nodes, req.Wait, func(ctx context.Context) error {
+		log.Info("SendToClient")
+		pushRsp, err := cli.SendToClient(ctx, pushReq)
 		if err != nil {
-			log.Error(err)
-		}
-	} else {
-		keys := make([]string, len(req.Uids))
-		for i, uid := range req.Uids {
-			keys[i] = fmt.Sprintf(tchatroom.RegUserKeyFmt, uid)
+			return err
 		}
-		nodes := internal.GetDistributeNodes(h.Etcd, keys, time.Millisecond*1000)
-		log.Infof("Nodes: %#v", nodes)
-		for id, _ := range nodes {
-			ctx, _ := context.WithTimeout(context.Background(), time.Millisecond*1000)
-			ctx = context.WithValue(ctx, wrapper.SelectNodeKey{}, id)
-			go func(ctx context.Context) {
-				data, err := json.Marshal(req.Data)
-				if err != nil {
-					log.Error(err)
-					return
-				}
-
-				pushReq := &push.SendToUserReq{
-					Uids: req.Uids,
-					Data: data,
-					Id:   req.Id,
-					Uid:  req.Uid,
-				}
-				log.Info("SendToUser")
-				_, err = h.PushCli.SendToUser(ctx, pushReq)
-				if err != nil {
-					log.Error(err)
-				}
-			}(ctx)
+		agg.add(pushRsp.Stats)
+		return nil
+	})
+
+	// 未等待各节点返回时没有统计，与是否分布式无关
+	rsp := &route.SendToRsp{}
+	if done {
+		rsp.Stats = agg.result(len(failed) > 0)
+		if len(failed) > 0 {
+			rsp.Code, rsp.Msg, rsp.FailedNodes = route.CodeNodesFailed, route.MsgNodesFailed, failed
 		}
 	}
-
-	if err := json.NewEncoder(w).Encode(&route.SendToRsp{}); err != nil {
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 }
 
-func (h *Handler) SendToChannel(w http.ResponseWriter, r *http.Request) {
-	var req route.SendToChannelReq
+func (h *Handler) SendToUser(w http.ResponseWriter, r *http.Request) {
+	var req route.SendToUserReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	req.Uids = uniqueInt64s(req.Uids)
 
-	opts := make([]client.Option, 0)
-	if h.Etcd != nil {
-		opts = append(opts, client.Wrap(clientWrapper))
+	data, err := json.Marshal(req.Data)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
 	}
-	cli := grpc.NewClient(opts...)
 
-	if h.PushCli == nil {
-		h.PushCli = push.NewPushService("tpush.srv.push", cli)
+	if h.Publisher != nil {
+		h.publish(&push.PushEnvelope{
+			Type: push.TargetType_TARGET_USER,
+			Uids: req.Uids,
+			Data: data,
+			Id:   req.Id,
+			Uid:  req.Uid,
+			Key:  req.Key,
+		})
+		if err := json.NewEncoder(w).Encode(&route.SendToRsp{}); err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+		return
+	}
+
+	pushReq := &push.SendToUserReq{
+		Uids: req.Uids,
+		Data: data,
+		Id:   req.Id,
+		Uid:  req.Uid,
+		Wait: req.Wait,
+		Key:  req.Key,
 	}
 
-	if h.Etcd == nil {
-		data, err := json.Marshal(req.Data)
+	var nodes []string
+	if h.distributed() {
+		nodes = h.Locator.Users(req.Uids)
+	}
+	agg := newStatsAggregator(int64Targets(req.Uids))
+	cli := h.pushCli()
+	done, failed := h.call(nodes, req.Wait, func(ctx context.Context) error {
+		log.Info("SendToUser")
+		pushRsp, err := cli.SendToUser(ctx, pushReq)
 		if err != nil {
-			log.Error(err)
-			return
+			return err
+		}
+		agg.add(pushRsp.Stats)
+		return nil
+	})
+
+	// 未等待各节点返回时没有统计，与是否分布式无关
+	rsp := &route.SendToRsp{}
+	if done {
+		rsp.Stats = agg.result(len(failed) > 0)
+		if len(failed) > 0 {
+			rsp.Code, rsp.Msg, rsp.FailedNodes = route.CodeNodesFailed, route.MsgNodesFailed, failed
 		}
+	}
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (h *Handler) SendToChannel(w http.ResponseWriter, r *http.Request) {
+	var req route.SendToChannelReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	req.Chans = uniqueStrings(req.Chans)
+
+	data, err := json.Marshal(req.Data)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 
-		pushReq := &push.SendToChannelReq{
+	if h.Publisher != nil {
+		h.publish(&push.PushEnvelope{
+			Type:  push.TargetType_TARGET_CHANNEL,
 			Chans: req.Chans,
 			Data:  data,
 			Id:    req.Id,
 			Uid:   req.Uid,
+			Key:   req.Key,
+		})
+		if err := json.NewEncoder(w).Encode(&route.SendToRsp{}); err != nil {
+			http.Error(w, err.Error(), 500)
 		}
+		return
+	}
+
+	pushReq := &push.SendToChannelReq{
+		Chans: req.Chans,
+		Data:  data,
+		Id:    req.Id,
+		Uid:   req.Uid,
+		Wait:  req.Wait,
+		Key:   req.Key,
+	}
+
+	var nodes []string
+	if h.distributed() {
+		nodes = h.Locator.Channels(req.Chans)
+	}
+	agg := newStatsAggregator(req.Chans)
+	cli := h.pushCli()
+	done, failed := h.call(nodes, req.Wait, func(ctx context.Context) error {
 		log.Info("SendToChannel")
-		ctx, _ := context.WithTimeout(context.Background(), time.Millisecond*1000)
-		_, err = h.PushCli.SendToChannel(ctx, pushReq)
+		pushRsp, err := cli.SendToChannel(ctx, pushReq)
 		if err != nil {
-			log.Error(err)
-		}
-	} else {
-		keys := make([]string, len(req.Chans))
-		for i, uid := range req.Chans {
-			keys[i] = fmt.Sprintf(tchatroom.RegChannelKeyFmt, uid)
+			return err
 		}
-		nodes := internal.GetDistributeNodes(h.Etcd, keys, time.Millisecond*1000)
-		log.Infof("Nodes: %#v", nodes)
-		for id, _ := range nodes {
-			ctx, _ := context.WithTimeout(context.Background(), time.Millisecond*1000)
-			ctx = context.WithValue(ctx, wrapper.SelectNodeKey{}, id)
-			go func(ctx context.Context) {
-				data, err := json.Marshal(req.Data)
-				if err != nil {
-					log.Error(err)
-					return
-				}
-
-				pushReq := &push.SendToChannelReq{
-					Chans: req.Chans,
-					Data:  data,
-					Id:    req.Id,
-					Uid:   req.Uid,
-				}
-				log.Info("SendMsgToChannel")
-				_, err = h.PushCli.SendToChannel(ctx, pushReq)
-				if err != nil {
-					log.Error(err)
-				}
-			}(ctx)
+		agg.add(pushRsp.Stats)
+		return nil
+	})
+
+	// 未等待各节点返回时没有统计，与是否分布式无关
+	rsp := &route.SendToRsp{}
+	if done {
+		rsp.Stats = agg.result(len(failed) > 0)
+		if len(failed) > 0 {
+			rsp.Code, rsp.Msg, rsp.FailedNodes = route.CodeNodesFailed, route.MsgNodesFailed, failed
 		}
 	}
-
-	if err := json.NewEncoder(w).Encode(&route.SendToRsp{}); err != nil {
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
@@ -0,0 +1,560 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/micro/go-micro/v2/client"
+	"github.com/micro/go-micro/v2/registry"
+	"github.com/micro/go-micro/v2/registry/memory"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+	"tpush/internal/tchatroom"
+	"tpush/internal/tchatroom/wstest"
+	"tpush/internal/twebsocket"
+	pushhandler "tpush/srv/push/handler"
+	push "tpush/srv/push/proto/push"
+	"tpush/srv/push/subscriber"
+	"tpush/web/route/locator"
+	route "tpush/web/route/proto"
+	"tpush/web/route/wrapper"
+)
+
+// 按wrapper.SelectNodeKey把请求直接分发给进程内对应节点的Push处理器
+type nodePushService struct {
+	push.PushService
+	nodes map[string]*pushhandler.Push
+
+	mu   sync.Mutex
+	down map[string]bool // 调用失败的节点
+}
+
+func (s *nodePushService) node(ctx context.Context) (*pushhandler.Push, error) {
+	id := ctx.Value(wrapper.SelectNodeKey{}).(string)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down[id] {
+		return nil, errors.New("node is down")
+	}
+	return s.nodes[id], nil
+}
+
+func (s *nodePushService) SetDown(id string, down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down[id] = down
+}
+
+func (s *nodePushService) SendToClient(ctx context.Context, in *push.SendToClientReq, opts ...client.CallOption) (*push.SendToClientRsp, error) {
+	n, err := s.node(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rsp := new(push.SendToClientRsp)
+	return rsp, n.SendToClient(ctx, in, rsp)
+}
+
+func (s *nodePushService) SendToUser(ctx context.Context, in *push.SendToUserReq, opts ...client.CallOption) (*push.SendToUserRsp, error) {
+	n, err := s.node(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rsp := new(push.SendToUserRsp)
+	return rsp, n.SendToUser(ctx, in, rsp)
+}
+
+func (s *nodePushService) SendToChannel(ctx context.Context, in *push.SendToChannelReq, opts ...client.CallOption) (*push.SendToChannelRsp, error) {
+	n, err := s.node(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rsp := new(push.SendToChannelRsp)
+	return rsp, n.SendToChannel(ctx, in, rsp)
+}
+
+func (s *nodePushService) IsOnline(ctx context.Context, in *push.IsOnlineReq, opts ...client.CallOption) (*push.IsOnlineRsp, error) {
+	n, err := s.node(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rsp := new(push.IsOnlineRsp)
+	return rsp, n.IsOnline(ctx, in, rsp)
+}
+
+func (s *nodePushService) ListClientsOfUser(ctx context.Context, in *push.ListClientsOfUserReq, opts ...client.CallOption) (*push.ListClientsOfUserRsp, error) {
+	n, err := s.node(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rsp := new(push.ListClientsOfUserRsp)
+	return rsp, n.ListClientsOfUser(ctx, in, rsp)
+}
+
+func (s *nodePushService) ListChannelMembers(ctx context.Context, in *push.ListChannelMembersReq, opts ...client.CallOption) (*push.ListChannelMembersRsp, error) {
+	n, err := s.node(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rsp := new(push.ListChannelMembersRsp)
+	return rsp, n.ListChannelMembers(ctx, in, rsp)
+}
+
+func (s *nodePushService) ChannelsOfClient(ctx context.Context, in *push.ChannelsOfClientReq, opts ...client.CallOption) (*push.ChannelsOfClientRsp, error) {
+	n, err := s.node(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rsp := new(push.ChannelsOfClientRsp)
+	return rsp, n.ChannelsOfClient(ctx, in, rsp)
+}
+
+func (s *nodePushService) CountOnline(ctx context.Context, in *push.CountOnlineReq, opts ...client.CallOption) (*push.CountOnlineRsp, error) {
+	n, err := s.node(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rsp := new(push.CountOnlineRsp)
+	return rsp, n.CountOnline(ctx, in, rsp)
+}
+
+func (s *nodePushService) SubscribeUser(ctx context.Context, in *push.SubscribeUserReq, opts ...client.CallOption) (*push.SubscribeUserRsp, error) {
+	n, err := s.node(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rsp := new(push.SubscribeUserRsp)
+	return rsp, n.SubscribeUser(ctx, in, rsp)
+}
+
+func (s *nodePushService) UnsubscribeUser(ctx context.Context, in *push.UnsubscribeUserReq, opts ...client.CallOption) (*push.UnsubscribeUserRsp, error) {
+	n, err := s.node(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rsp := new(push.UnsubscribeUserRsp)
+	return rsp, n.UnsubscribeUser(ctx, in, rsp)
+}
+
+func (s *nodePushService) Kick(ctx context.Context, in *push.KickReq, opts ...client.CallOption) (*push.KickRsp, error) {
+	n, err := s.node(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rsp := new(push.KickRsp)
+	return rsp, n.Kick(ctx, in, rsp)
+}
+
+// 模拟broker，把消息投递给每个节点的订阅者
+type fanoutPublisher struct {
+	subs []*subscriber.Push
+}
+
+func (p *fanoutPublisher) Publish(ctx context.Context, msg interface{}, opts ...client.PublishOption) error {
+	for _, sub := range p.subs {
+		if err := sub.Handle(ctx, msg.(*push.PushEnvelope)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type cluster struct {
+	reg   registry.Registry
+	loc   locator.Locator
+	srvs  map[string]*httptest.Server
+	push  *nodePushService
+	pub   *fanoutPublisher
+	stops []func()
+}
+
+func (c *cluster) Close() {
+	for _, srv := range c.srvs {
+		srv.Close()
+	}
+	for _, stop := range c.stops {
+		stop()
+	}
+}
+
+func newCluster(nodes ...string) *cluster {
+	store := tchatroom.NewMemoryStore()
+	c := &cluster{
+		loc:  locator.NewMemoryLocator(store),
+		srvs: make(map[string]*httptest.Server),
+		push: &nodePushService{
+			nodes: make(map[string]*pushhandler.Push),
+			down:  make(map[string]bool),
+		},
+		pub: &fanoutPublisher{},
+		reg: memory.NewRegistry(),
+	}
+	service := &registry.Service{Name: pushServiceName}
+	subs := tchatroom.NewMemorySubscriptionStore()
+	for i, node := range nodes {
+		d := tchatroom.NewMemoryDistribute(node, store)
+		c.stops = append(c.stops, d.Run())
+		svc := tchatroom.NewService(
+			tchatroom.WithDistribute(d),
+			tchatroom.WithIdGenerator(tchatroom.NewSnowflakeIdGenerator(int64(i))),
+			tchatroom.WithSubscriptionStore(subs),
+		)
+		c.srvs[node] = httptest.NewServer(svc)
+		c.push.nodes[node] = &pushhandler.Push{Room: svc.Room}
+		c.pub.subs = append(c.pub.subs, &subscriber.Push{Room: svc.Room})
+		service.Nodes = append(service.Nodes, &registry.Node{Id: node})
+	}
+	c.reg.Register(service)
+	return c
+}
+
+func (c *cluster) Dial(t *testing.T, node string, uid int64, chans ...string) *wstest.Client {
+	cli, _ := c.DialId(t, node, uid, chans...)
+	return cli
+}
+
+func (c *cluster) DialId(t *testing.T, node string, uid int64, chans ...string) (*wstest.Client, int64) {
+	cli, login := wstest.Login(t, c.srvs[node], uid)
+	if len(chans) > 0 {
+		cli.Request(tchatroom.CmdEnter, &tchatroom.EnterChanReq{Chans: chans})
+		if _, err := cli.Recv(tchatroom.CmdEnter, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 等待注册生效
+	for i := 0; i < 100 && len(c.loc.Users([]int64{uid})) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	return cli, login.Id
+}
+
+func expectData(t *testing.T, cli *wstest.Client, want string) {
+	rsp, err := cli.Recv(tchatroom.CmdRecvData, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data tchatroom.RecvDataRsp
+	if err := twebsocket.DecodeData(rsp.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Data != want {
+		t.Fatalf("received %#v, want %#v", data.Data, want)
+	}
+}
+
+func TestHandler_SendToClient_CrossNode(t *testing.T) {
+	c := newCluster("node-a", "node-b")
+	defer c.Close()
+
+	a, aid := c.DialId(t, "node-a", 1001)
+	defer a.Conn.Close()
+	b, bid := c.DialId(t, "node-b", 1001)
+	defer b.Conn.Close()
+	if aid == bid {
+		t.Fatalf("client ids collide across nodes: %d", aid)
+	}
+
+	h := &Handler{Locator: c.loc, PushCli: c.push}
+	body, _ := json.Marshal(&route.SendToClientReq{Ids: []int64{bid}, Data: "device"})
+	w := httptest.NewRecorder()
+	h.SendToClient(w, httptest.NewRequest("POST", "/cmd/snd2cli", bytes.NewReader(body)))
+
+	expectData(t, b, "device")
+}
+
+func TestHandler_SendToUser_CrossNode(t *testing.T) {
+	c := newCluster("node-a", "node-b")
+	defer c.Close()
+
+	a := c.Dial(t, "node-a", 1001)
+	defer a.Conn.Close()
+	b := c.Dial(t, "node-b", 1002)
+	defer b.Conn.Close()
+
+	h := &Handler{Locator: c.loc, PushCli: c.push}
+	body, _ := json.Marshal(&route.SendToUserReq{Uids: []int64{1001, 1002}, Data: "hello"})
+	w := httptest.NewRecorder()
+	h.SendToUser(w, httptest.NewRequest("POST", "/cmd/snd2usr", bytes.NewReader(body)))
+
+	expectData(t, a, "hello")
+	expectData(t, b, "hello")
+}
+
+func TestHandler_SendToUser_Stats(t *testing.T) {
+	c := newCluster("node-a", "node-b")
+	defer c.Close()
+
+	a := c.Dial(t, "node-a", 1001)
+	defer a.Conn.Close()
+	b := c.Dial(t, "node-b", 1001)
+	defer b.Conn.Close()
+
+	h := &Handler{Locator: c.loc, PushCli: c.push}
+	// 重复的目标只投递和统计一次
+	body, _ := json.Marshal(&route.SendToUserReq{Uids: []int64{1001, 1002, 1001}, Data: "hello", Wait: true})
+	w := httptest.NewRecorder()
+	h.SendToUser(w, httptest.NewRequest("POST", "/cmd/snd2usr", bytes.NewReader(body)))
+
+	var rsp route.SendToRsp
+	if err := json.NewDecoder(w.Body).Decode(&rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Stats == nil {
+		t.Fatal("missing stats")
+	}
+	if rsp.Stats.Matched != 2 || rsp.Stats.Enqueued != 2 || rsp.Stats.NotFound != 1 {
+		t.Fatalf("unexpected stats: %+v", rsp.Stats)
+	}
+	if len(rsp.Stats.Targets) != 2 || rsp.Stats.Targets[0].Target != "1001" || rsp.Stats.Targets[1].Matched != 0 {
+		t.Fatalf("unexpected target stats: %+v", rsp.Stats.Targets)
+	}
+	expectData(t, a, "hello")
+	expectData(t, b, "hello")
+	if _, err := a.Recv(tchatroom.CmdRecvData, time.Millisecond*100); err == nil {
+		t.Fatal("duplicate target delivered twice")
+	}
+
+	// 不等待时立即返回，没有统计
+	body, _ = json.Marshal(&route.SendToUserReq{Uids: []int64{1001}, Data: "again"})
+	w = httptest.NewRecorder()
+	h.SendToUser(w, httptest.NewRequest("POST", "/cmd/snd2usr", bytes.NewReader(body)))
+	rsp = route.SendToRsp{}
+	if err := json.NewDecoder(w.Body).Decode(&rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Stats != nil {
+		t.Fatalf("stats without wait: %+v", rsp.Stats)
+	}
+	// a已因读超时不可再读
+	expectData(t, b, "again")
+
+	// 节点调用失败时返回失败的节点，未匹配的目标不计为not found
+	c.push.SetDown("node-b", true)
+	body, _ = json.Marshal(&route.SendToUserReq{Uids: []int64{1001, 1002}, Data: "partial", Wait: true})
+	w = httptest.NewRecorder()
+	h.SendToUser(w, httptest.NewRequest("POST", "/cmd/snd2usr", bytes.NewReader(body)))
+	rsp = route.SendToRsp{}
+	if err := json.NewDecoder(w.Body).Decode(&rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Code != route.CodeNodesFailed || !reflect.DeepEqual(rsp.FailedNodes, []string{"node-b"}) {
+		t.Fatalf("unexpected failure: %d %v", rsp.Code, rsp.FailedNodes)
+	}
+	if rsp.Stats == nil || rsp.Stats.Matched != 1 || rsp.Stats.NotFound != 0 || rsp.Stats.Unknown != 1 {
+		t.Fatalf("unexpected stats: %+v", rsp.Stats)
+	}
+}
+
+func TestHandler_SendToChannel_CrossNode(t *testing.T) {
+	c := newCluster("node-a", "node-b")
+	defer c.Close()
+
+	a := c.Dial(t, "node-a", 1001, "world")
+	defer a.Conn.Close()
+	b := c.Dial(t, "node-b", 1002, "world")
+	defer b.Conn.Close()
+
+	h := &Handler{Locator: c.loc, PushCli: c.push}
+	body, _ := json.Marshal(&route.SendToChannelReq{Chans: []string{"world"}, Data: "hi"})
+	w := httptest.NewRecorder()
+	h.SendToChannel(w, httptest.NewRequest("POST", "/cmd/snd2chan", bytes.NewReader(body)))
+
+	expectData(t, a, "hi")
+	expectData(t, b, "hi")
+}
+
+func TestHandler_SendToChannel_Broker(t *testing.T) {
+	c := newCluster("node-a", "node-b")
+	defer c.Close()
+
+	a := c.Dial(t, "node-a", 1001, "world")
+	defer a.Conn.Close()
+	b := c.Dial(t, "node-b", 1002, "world")
+	defer b.Conn.Close()
+
+	h := &Handler{Publisher: c.pub}
+	body, _ := json.Marshal(&route.SendToChannelReq{Chans: []string{"world"}, Data: "broadcast"})
+	w := httptest.NewRecorder()
+	h.SendToChannel(w, httptest.NewRequest("POST", "/cmd/snd2chan", bytes.NewReader(body)))
+
+	expectData(t, a, "broadcast")
+	expectData(t, b, "broadcast")
+}
+
+func TestHandler_Presence_CrossNode(t *testing.T) {
+	c := newCluster("node-a", "node-b")
+	defer c.Close()
+
+	a, aid := c.DialId(t, "node-a", 1001, "world")
+	defer a.Conn.Close()
+	b, bid := c.DialId(t, "node-b", 1001, "world")
+	defer b.Conn.Close()
+	d, did := c.DialId(t, "node-b", 1002, "world", "news")
+	defer d.Conn.Close()
+
+	h := &Handler{Locator: c.loc, PushCli: c.push, Registry: c.reg}
+	do := func(f func(w http.ResponseWriter, r *http.Request), req interface{}, rsp interface{}) {
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		f(w, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+		if err := json.NewDecoder(w.Body).Decode(rsp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var online route.IsOnlineRsp
+	do(h.IsOnline, &route.IsOnlineReq{Uids: []int64{1003, 1002, 1001}}, &online)
+	if !reflect.DeepEqual(online.Online, []int64{1002, 1001}) {
+		t.Fatalf("online: %v", online.Online)
+	}
+
+	var clis route.ListClientsOfUserRsp
+	do(h.ListClientsOfUser, &route.ListClientsOfUserReq{Uid: 1001}, &clis)
+	if len(clis.Ids) != 2 || !(clis.Ids[0] == aid && clis.Ids[1] == bid || clis.Ids[0] == bid && clis.Ids[1] == aid) {
+		t.Fatalf("clients of user: %v, want %d and %d", clis.Ids, aid, bid)
+	}
+
+	var mbrs route.ListChannelMembersRsp
+	do(h.ListChannelMembers, &route.ListChannelMembersReq{Chan: "world"}, &mbrs)
+	if len(mbrs.Members) != 3 {
+		t.Fatalf("channel members: %d, want 3", len(mbrs.Members))
+	}
+
+	var chans route.ChannelsOfClientRsp
+	do(h.ChannelsOfClient, &route.ChannelsOfClientReq{Id: did}, &chans)
+	if !reflect.DeepEqual(chans.Chans, []string{"news", "world"}) {
+		t.Fatalf("channels of client: %v", chans.Chans)
+	}
+
+	var cnt route.CountOnlineRsp
+	do(h.CountOnline, struct{}{}, &cnt)
+	if cnt.Clients != 3 || cnt.Users != 3 {
+		t.Fatalf("count online: %+v", cnt)
+	}
+
+	// 节点调用失败时其上的用户不能被当作离线
+	c.push.SetDown("node-b", true)
+	online = route.IsOnlineRsp{}
+	do(h.IsOnline, &route.IsOnlineReq{Uids: []int64{1002, 1001}}, &online)
+	if online.Code != route.CodeNodesFailed || !reflect.DeepEqual(online.FailedNodes, []string{"node-b"}) {
+		t.Fatalf("online with node down: %+v", online)
+	}
+	cnt = route.CountOnlineRsp{}
+	do(h.CountOnline, struct{}{}, &cnt)
+	if cnt.Code != route.CodeNodesFailed || cnt.Clients != 1 {
+		t.Fatalf("count online with node down: %+v", cnt)
+	}
+}
+
+func TestHandler_SubscribeUser_Persist(t *testing.T) {
+	c := newCluster("node-a", "node-b")
+	defer c.Close()
+
+	a := c.Dial(t, "node-a", 1001)
+	defer a.Conn.Close()
+
+	h := &Handler{Locator: c.loc, PushCli: c.push, Registry: c.reg}
+	body, _ := json.Marshal(&route.SubscribeUserReq{Uids: []int64{1001}, Chans: []string{"room1"}, Persist: true})
+	w := httptest.NewRecorder()
+	h.SubscribeUser(w, httptest.NewRequest("POST", "/cmd/subusr", bytes.NewReader(body)))
+	var sub route.SubscribeRsp
+	if err := json.NewDecoder(w.Body).Decode(&sub); err != nil {
+		t.Fatal(err)
+	}
+	if sub.Clients != 1 {
+		t.Fatalf("subscribed clients: %d, want 1", sub.Clients)
+	}
+
+	// 之后登录到其他节点的连接自动进入频道
+	b := c.Dial(t, "node-b", 1001)
+	defer b.Conn.Close()
+	for i := 0; i < 100 && len(c.loc.Channels([]string{"room1"})) < 2; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	body, _ = json.Marshal(&route.SendToChannelReq{Chans: []string{"room1"}, Data: "moved"})
+	h.SendToChannel(httptest.NewRecorder(), httptest.NewRequest("POST", "/cmd/snd2chan", bytes.NewReader(body)))
+	expectData(t, a, "moved")
+	expectData(t, b, "moved")
+
+	body, _ = json.Marshal(&route.UnsubscribeUserReq{Uids: []int64{1001}, Chans: []string{"room1"}})
+	w = httptest.NewRecorder()
+	h.UnsubscribeUser(w, httptest.NewRequest("POST", "/cmd/unsubusr", bytes.NewReader(body)))
+	if err := json.NewDecoder(w.Body).Decode(&sub); err != nil {
+		t.Fatal(err)
+	}
+	if sub.Clients != 2 {
+		t.Fatalf("unsubscribed clients: %d, want 2", sub.Clients)
+	}
+	for i := 0; i < 100 && len(c.loc.Channels([]string{"room1"})) > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if nodes := c.loc.Channels([]string{"room1"}); len(nodes) != 0 {
+		t.Fatalf("channel still registered on %v", nodes)
+	}
+
+	// 用户不在线时也会保存，之后登录的节点从共享存储读取
+	body, _ = json.Marshal(&route.SubscribeUserReq{Uids: []int64{1003}, Chans: []string{"room2"}, Persist: true})
+	h.SubscribeUser(httptest.NewRecorder(), httptest.NewRequest("POST", "/cmd/subusr", bytes.NewReader(body)))
+	d := c.Dial(t, "node-b", 1003)
+	defer d.Conn.Close()
+	for i := 0; i < 100 && len(c.loc.Channels([]string{"room2"})) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if nodes := c.loc.Channels([]string{"room2"}); !reflect.DeepEqual(nodes, []string{"node-b"}) {
+		t.Fatalf("offline subscription registered on %v", nodes)
+	}
+}
+
+func TestHandler_Kick_CrossNode(t *testing.T) {
+	c := newCluster("node-a", "node-b")
+	defer c.Close()
+
+	a := c.Dial(t, "node-a", 1001)
+	defer a.Conn.Close()
+	b := c.Dial(t, "node-b", 1001, "world")
+	defer b.Conn.Close()
+	d := c.Dial(t, "node-b", 1002)
+	defer d.Conn.Close()
+
+	h := &Handler{Locator: c.loc, PushCli: c.push}
+	body, _ := json.Marshal(&route.KickReq{Uids: []int64{1001}, Chans: []string{"world"}, Code: 3, Reason: "banned"})
+	w := httptest.NewRecorder()
+	h.Kick(w, httptest.NewRequest("POST", "/cmd/kick", bytes.NewReader(body)))
+	var rsp route.KickRsp
+	if err := json.NewDecoder(w.Body).Decode(&rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Clients != 2 {
+		t.Fatalf("kicked clients: %d, want 2", rsp.Clients)
+	}
+
+	for _, cli := range []*wstest.Client{a, b} {
+		notice, err := cli.Recv(tchatroom.CmdNotice, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data tchatroom.NoticeRsp
+		if err := twebsocket.DecodeData(notice.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.Type != tchatroom.NoticeKick || data.Code != 3 || data.Reason != "banned" {
+			t.Fatalf("unexpected notice: %+v", data)
+		}
+		if _, err := cli.Recv(tchatroom.CmdNotice, time.Second); err == nil {
+			t.Fatal("connection not closed after kick")
+		}
+	}
+
+	for i := 0; i < 100 && len(c.loc.Users([]int64{1001})) > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if nodes := c.loc.Users([]int64{1001}); len(nodes) != 0 {
+		t.Fatalf("kicked user still registered on %v", nodes)
+	}
+}
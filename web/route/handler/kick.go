@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	push "tpush/srv/push/proto/push"
+	"tpush/web/route/locator"
+	route "tpush/web/route/proto"
+)
+
+func (h *Handler) Kick(w http.ResponseWriter, r *http.Request) {
+	var req route.KickReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	nodes := h.locate(func(loc locator.Locator) []string {
+		set := make(map[string]struct{})
+		for _, nodes := range [][]string{loc.Clients(req.Ids), loc.Users(req.Uids), loc.Channels(req.Chans)} {
+			for _, node := range nodes {
+				set[node] = struct{}{}
+			}
+		}
+		nodes := make([]string, 0, len(set))
+		for node := range set {
+			nodes = append(nodes, node)
+		}
+		return nodes
+	})
+
+	var clients int32
+	cli := h.pushCli()
+	h.call(nodes, true, func(ctx context.Context) error {
+		pushRsp, err := cli.Kick(ctx, &push.KickReq{
+			Ids:    req.Ids,
+			Uids:   req.Uids,
+			Chans:  req.Chans,
+			Code:   req.Code,
+			Reason: req.Reason,
+		})
+		if err != nil {
+			return err
+		}
+		atomic.AddInt32(&clients, pushRsp.Clients)
+		return nil
+	})
+
+	if err := json.NewEncoder(w).Encode(&route.KickRsp{Clients: int(clients)}); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	push "tpush/srv/push/proto/push"
+	"tpush/web/route/locator"
+	route "tpush/web/route/proto"
+)
+
+func (h *Handler) IsOnline(w http.ResponseWriter, r *http.Request) {
+	var req route.IsOnlineReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	nodes := h.locate(func(loc locator.Locator) []string {
+		return loc.Users(req.Uids)
+	})
+
+	var mu sync.Mutex
+	online := make(map[int64]struct{})
+	cli := h.pushCli()
+	_, failed := h.call(nodes, true, func(ctx context.Context) error {
+		pushRsp, err := cli.IsOnline(ctx, &push.IsOnlineReq{Uids: req.Uids})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		for _, uid := range pushRsp.Online {
+			online[uid] = struct{}{}
+		}
+		mu.Unlock()
+		return nil
+	})
+
+	// 保持请求中的顺序
+	rsp := route.IsOnlineRsp{
+		Online: make([]int64, 0, len(online)),
+	}
+	// 失败节点上的用户状态未知，不能视为离线
+	if len(failed) > 0 {
+		rsp.Code, rsp.Msg, rsp.FailedNodes = route.CodeNodesFailed, route.MsgNodesFailed, failed
+	}
+	for _, uid := range req.Uids {
+		if _, ok := online[uid]; ok {
+			rsp.Online = append(rsp.Online, uid)
+			delete(online, uid)
+		}
+	}
+	if err := json.NewEncoder(w).Encode(&rsp); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (h *Handler) ListClientsOfUser(w http.ResponseWriter, r *http.Request) {
+	var req route.ListClientsOfUserReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	nodes := h.locate(func(loc locator.Locator) []string {
+		return loc.Users([]int64{req.Uid})
+	})
+
+	var mu sync.Mutex
+	rsp := route.ListClientsOfUserRsp{
+		Ids: make([]int64, 0),
+	}
+	cli := h.pushCli()
+	_, failed := h.call(nodes, true, func(ctx context.Context) error {
+		pushRsp, err := cli.ListClientsOfUser(ctx, &push.ListClientsOfUserReq{Uid: req.Uid})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		rsp.Ids = append(rsp.Ids, pushRsp.Ids...)
+		mu.Unlock()
+		return nil
+	})
+
+	if len(failed) > 0 {
+		rsp.Code, rsp.Msg, rsp.FailedNodes = route.CodeNodesFailed, route.MsgNodesFailed, failed
+	}
+	sort.Slice(rsp.Ids, func(i, j int) bool {
+		return rsp.Ids[i] < rsp.Ids[j]
+	})
+	if err := json.NewEncoder(w).Encode(&rsp); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (h *Handler) ListChannelMembers(w http.ResponseWriter, r *http.Request) {
+	var req route.ListChannelMembersReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	nodes := h.locate(func(loc locator.Locator) []string {
+		return loc.Channels([]string{req.Chan})
+	})
+
+	var mu sync.Mutex
+	rsp := route.ListChannelMembersRsp{
+		Members: make([]*route.ClientInfo, 0),
+	}
+	cli := h.pushCli()
+	_, failed := h.call(nodes, true, func(ctx context.Context) error {
+		pushRsp, err := cli.ListChannelMembers(ctx, &push.ListChannelMembersReq{Chan: req.Chan})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		for _, m := range pushRsp.Members {
+			rsp.Members = append(rsp.Members, &route.ClientInfo{
+				Id:  m.Id,
+				Uid: m.Uid,
+			})
+		}
+		mu.Unlock()
+		return nil
+	})
+
+	if len(failed) > 0 {
+		rsp.Code, rsp.Msg, rsp.FailedNodes = route.CodeNodesFailed, route.MsgNodesFailed, failed
+	}
+	sort.Slice(rsp.Members, func(i, j int) bool {
+		return rsp.Members[i].Id < rsp.Members[j].Id
+	})
+	if err := json.NewEncoder(w).Encode(&rsp); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (h *Handler) ChannelsOfClient(w http.ResponseWriter, r *http.Request) {
+	var req route.ChannelsOfClientReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	nodes := h.locate(func(loc locator.Locator) []string {
+		return loc.Clients([]int64{req.Id})
+	})
+
+	var mu sync.Mutex
+	rsp := route.ChannelsOfClientRsp{
+		Chans: make([]string, 0),
+	}
+	cli := h.pushCli()
+	_, failed := h.call(nodes, true, func(ctx context.Context) error {
+		pushRsp, err := cli.ChannelsOfClient(ctx, &push.ChannelsOfClientReq{Id: req.Id})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		rsp.Chans = append(rsp.Chans, pushRsp.Chans...)
+		mu.Unlock()
+		return nil
+	})
+
+	if len(failed) > 0 {
+		rsp.Code, rsp.Msg, rsp.FailedNodes = route.CodeNodesFailed, route.MsgNodesFailed, failed
+	}
+	sort.Strings(rsp.Chans)
+	if err := json.NewEncoder(w).Encode(&rsp); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (h *Handler) CountOnline(w http.ResponseWriter, r *http.Request) {
+	var nodes []string
+	if h.distributed() {
+		nodes = h.allNodes()
+	}
+
+	var mu sync.Mutex
+	var rsp route.CountOnlineRsp
+	cli := h.pushCli()
+	_, failed := h.call(nodes, true, func(ctx context.Context) error {
+		pushRsp, err := cli.CountOnline(ctx, &push.CountOnlineReq{})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		rsp.Clients += pushRsp.Clients
+		rsp.Users += pushRsp.Users
+		mu.Unlock()
+		return nil
+	})
+	if len(failed) > 0 {
+		rsp.Code, rsp.Msg, rsp.FailedNodes = route.CodeNodesFailed, route.MsgNodesFailed, failed
+	}
+
+	if err := json.NewEncoder(w).Encode(&rsp); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"strconv"
+	"sync"
+	push "tpush/srv/push/proto/push"
+	route "tpush/web/route/proto"
+)
+
+// 汇总各节点返回的投递统计，目标在所有节点上都未匹配到客户端时计为not found
+// 有节点调用失败时无法确定未匹配的目标是否在失败的节点上，计为unknown
+type statsAggregator struct {
+	mu      sync.Mutex
+	targets []string
+	m       map[string]*route.TargetStats
+}
+
+func (a *statsAggregator) add(stats *push.DeliveryStats) {
+	if stats == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, ts := range stats.Targets {
+		t, ok := a.m[ts.Target]
+		if !ok {
+			continue
+		}
+		t.Matched += int(ts.Matched)
+		t.Enqueued += int(ts.Enqueued)
+		t.Dropped += int(ts.Dropped)
+	}
+}
+
+func (a *statsAggregator) result(failed bool) *route.DeliveryStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ret := &route.DeliveryStats{
+		Targets: make([]*route.TargetStats, 0, len(a.m)),
+	}
+	for _, target := range a.targets {
+		t, ok := a.m[target]
+		if !ok {
+			continue
+		}
+		ret.Targets = append(ret.Targets, t)
+		ret.Matched += t.Matched
+		ret.Enqueued += t.Enqueued
+		ret.Dropped += t.Dropped
+		if t.Matched == 0 {
+			if failed {
+				ret.Unknown++
+			} else {
+				ret.NotFound++
+			}
+		}
+	}
+	return ret
+}
+
+func newStatsAggregator(targets []string) *statsAggregator {
+	a := &statsAggregator{
+		targets: uniqueStrings(targets),
+		m:       make(map[string]*route.TargetStats, len(targets)),
+	}
+	for _, target := range a.targets {
+		a.m[target] = &route.TargetStats{Target: target}
+	}
+	return a
+}
+
+// 去除重复的目标，保持原有顺序
+func uniqueInt64s(ids []int64) []int64 {
+	seen := make(map[int64]struct{}, len(ids))
+	ret := ids[:0:0]
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		ret = append(ret, id)
+	}
+	return ret
+}
+
+func uniqueStrings(ss []string) []string {
+	seen := make(map[string]struct{}, len(ss))
+	ret := ss[:0:0]
+	for _, s := range ss {
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+func int64Targets(ids []int64) []string {
+	targets := make([]string, len(ids))
+	for i, id := range ids {
+		targets[i] = strconv.FormatInt(id, 10)
+	}
+	return targets
+}
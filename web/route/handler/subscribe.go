@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	push "tpush/srv/push/proto/push"
+	"tpush/web/route/locator"
+	route "tpush/web/route/proto"
+)
+
+func (h *Handler) SubscribeUser(w http.ResponseWriter, r *http.Request) {
+	var req route.SubscribeUserReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// 持久订阅由各节点写入共享存储，用户不在线时也需调用至少一个节点
+	nodes := h.locate(func(loc locator.Locator) []string {
+		return loc.Users(req.Uids)
+	})
+	if req.Persist && h.distributed() && len(nodes) == 0 {
+		if all := h.allNodes(); len(all) > 0 {
+			nodes = all[:1]
+		}
+	}
+
+	var clients int32
+	cli := h.pushCli()
+	_, failed := h.call(nodes, true, func(ctx context.Context) error {
+		pushRsp, err := cli.SubscribeUser(ctx, &push.SubscribeUserReq{
+			Uids:    req.Uids,
+			Chans:   req.Chans,
+			Persist: req.Persist,
+		})
+		if err != nil {
+			return err
+		}
+		atomic.AddInt32(&clients, pushRsp.Clients)
+		return nil
+	})
+
+	rsp := route.SubscribeRsp{Clients: int(clients)}
+	if len(failed) > 0 {
+		rsp.Code, rsp.Msg, rsp.FailedNodes = route.CodeNodesFailed, route.MsgNodesFailed, failed
+	}
+	if err := json.NewEncoder(w).Encode(&rsp); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
+
+func (h *Handler) UnsubscribeUser(w http.ResponseWriter, r *http.Request) {
+	var req route.UnsubscribeUserReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// 持久订阅保存在共享存储中，用户不在线时也需调用至少一个节点
+	nodes := h.locate(func(loc locator.Locator) []string {
+		return loc.Users(req.Uids)
+	})
+	if h.distributed() && len(nodes) == 0 {
+		if all := h.allNodes(); len(all) > 0 {
+			nodes = all[:1]
+		}
+	}
+
+	var clients int32
+	cli := h.pushCli()
+	_, failed := h.call(nodes, true, func(ctx context.Context) error {
+		pushRsp, err := cli.UnsubscribeUser(ctx, &push.UnsubscribeUserReq{
+			Uids:  req.Uids,
+			Chans: req.Chans,
+		})
+		if err != nil {
+			return err
+		}
+		atomic.AddInt32(&clients, pushRsp.Clients)
+		return nil
+	})
+
+	rsp := route.SubscribeRsp{Clients: int(clients)}
+	if len(failed) > 0 {
+		rsp.Code, rsp.Msg, rsp.FailedNodes = route.CodeNodesFailed, route.MsgNodesFailed, failed
+	}
+	if err := json.NewEncoder(w).Encode(&rsp); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+}
@@ -0,0 +1,97 @@
+package locator
+
+import (
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/go-redis/redis/v7"
+	"time"
+	"tpush/internal"
+	"tpush/internal/tchatroom"
+)
+
+var (
+	LookupTimeout = time.Millisecond * 1000
+)
+
+// 将用户、客户端、频道解析为所在的节点标识
+type Locator interface {
+	Users(uids []int64) []string
+	Clients(ids []int64) []string
+	Channels(chans []string) []string
+}
+
+// 基于注册key查询的实现，lookup返回node -> key
+type keyLocator struct {
+	lookup func(keys []string) map[string]string
+}
+
+func (l *keyLocator) nodes(keys []string) []string {
+	nodes := l.lookup(keys)
+	ret := make([]string, 0, len(nodes))
+	for node := range nodes {
+		ret = append(ret, node)
+	}
+	return ret
+}
+
+func (l *keyLocator) Users(uids []int64) []string {
+	keys := make([]string, len(uids))
+	for i, uid := range uids {
+		keys[i] = fmt.Sprintf(tchatroom.RegUserKeyFmt, uid)
+	}
+	return l.nodes(keys)
+}
+
+func (l *keyLocator) Clients(ids []int64) []string {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = fmt.Sprintf(tchatroom.RegClientKeyFmt, id)
+	}
+	return l.nodes(keys)
+}
+
+func (l *keyLocator) Channels(chans []string) []string {
+	keys := make([]string, len(chans))
+	for i, ch := range chans {
+		keys[i] = fmt.Sprintf(tchatroom.RegChannelKeyFmt, ch)
+	}
+	return l.nodes(keys)
+}
+
+func NewEtcdLocator(cli *clientv3.Client) Locator {
+	return &keyLocator{lookup: func(keys []string) map[string]string {
+		return internal.GetDistributeNodes(cli, keys, LookupTimeout)
+	}}
+}
+
+func NewRedisLocator(cli *redis.Client) Locator {
+	return &keyLocator{lookup: func(keys []string) map[string]string {
+		return internal.GetRedisDistributeNodes(cli, keys, LookupTimeout)
+	}}
+}
+
+// 进程内注册存储，用于单机部署及测试
+func NewMemoryLocator(store *tchatroom.MemoryStore) Locator {
+	return &keyLocator{lookup: store.Nodes}
+}
+
+// 固定节点列表，任何目标都解析为全部节点
+type staticLocator struct {
+	nodes []string
+}
+
+func (l *staticLocator) Users(uids []int64) []string {
+	return l.nodes
+}
+
+func (l *staticLocator) Clients(ids []int64) []string {
+	return l.nodes
+}
+
+func (l *staticLocator) Channels(chans []string) []string {
+	return l.nodes
+}
+
+func NewStaticLocator(nodes ...string) Locator {
+	return &staticLocator{nodes: nodes}
+}
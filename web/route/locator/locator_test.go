@@ -0,0 +1,113 @@
+package locator
+
+import (
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"reflect"
+	"sort"
+	"testing"
+	"tpush/internal/tchatroom"
+)
+
+func TestSplitNodeKey(t *testing.T) {
+	for _, c := range []struct {
+		k         string
+		key, node string
+		ok        bool
+	}{
+		{"/uids/1001/node-a", "/uids/1001", "node-a", true},
+		{"/chans/room/1/node-a", "/chans/room/1", "node-a", true},
+		{"/uids/1001/", "", "", false},
+		{"/node-a", "", "", false},
+		{"node-a", "", "", false},
+	} {
+		key, node, ok := splitNodeKey(c.k)
+		if key != c.key || node != c.node || ok != c.ok {
+			t.Fatalf("%s: %q %q %v", c.k, key, node, ok)
+		}
+	}
+}
+
+func sortedNodes(nodes map[string]struct{}) []string {
+	ret := make([]string, 0, len(nodes))
+	for node := range nodes {
+		ret = append(ret, node)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestRouteTable(t *testing.T) {
+	table := &routeTable{
+		keys:   make(map[string]map[string]struct{}),
+		synced: make(map[string]bool),
+	}
+	prefix := tchatroom.RegUserKeyPrefix
+
+	// 未加载快照时需回退到直接查询
+	if _, ok := table.lookup(prefix, []string{"/uids/1"}); ok {
+		t.Fatal("lookup before sync")
+	}
+
+	table.reset(prefix, []*mvccpb.KeyValue{
+		{Key: []byte("/uids/1/node-a")},
+		{Key: []byte("/uids/1/node-b")},
+		{Key: []byte("/uids/2/node-a")},
+	})
+	event := func(typ mvccpb.Event_EventType, k string) *clientv3.Event {
+		return &clientv3.Event{Type: typ, Kv: &mvccpb.KeyValue{Key: []byte(k)}}
+	}
+	table.apply([]*clientv3.Event{
+		event(mvccpb.DELETE, "/uids/1/node-b"),
+		event(mvccpb.PUT, "/uids/3/node-c"),
+		event(mvccpb.DELETE, "/uids/2/node-a"),
+		event(mvccpb.DELETE, "/uids/4/node-a"),
+	})
+
+	nodes, ok := table.lookup(prefix, []string{"/uids/1", "/uids/2", "/uids/3"})
+	if got := sortedNodes(nodes); !ok || !reflect.DeepEqual(got, []string{"node-a", "node-c"}) {
+		t.Fatalf("nodes: %v", got)
+	}
+	// 最后一个节点注销后key被移除，已同步时未命中即未注册
+	if nodes, ok := table.lookup(prefix, []string{"/uids/2"}); !ok || len(nodes) != 0 {
+		t.Fatalf("unregistered key: %v %v", nodes, ok)
+	}
+	if _, ok := table.keys["/uids/2"]; ok {
+		t.Fatal("empty key not removed")
+	}
+
+	// 重新加载只替换该前缀下的key
+	table.reset(tchatroom.RegChannelKeyPrefix, []*mvccpb.KeyValue{{Key: []byte("/chans/a/b/node-a")}})
+	table.reset(prefix, []*mvccpb.KeyValue{{Key: []byte("/uids/5/node-b")}})
+	if nodes, _ := table.lookup(prefix, []string{"/uids/1", "/uids/5"}); !reflect.DeepEqual(sortedNodes(nodes), []string{"node-b"}) {
+		t.Fatalf("nodes after reset: %v", nodes)
+	}
+	if nodes, _ := table.lookup(tchatroom.RegChannelKeyPrefix, []string{"/chans/a/b"}); len(nodes) != 1 {
+		t.Fatalf("channel nodes: %v", nodes)
+	}
+
+	table.unsync(prefix)
+	if _, ok := table.lookup(prefix, []string{"/uids/5"}); ok {
+		t.Fatal("hit after unsync")
+	}
+}
+
+func TestMemoryLocator(t *testing.T) {
+	store := tchatroom.NewMemoryStore()
+	a := tchatroom.NewMemoryDistribute("node-a", store)
+	b := tchatroom.NewMemoryDistribute("node-b", store)
+	a.Register("/uids/1")
+	b.Register("/uids/1")
+	b.Register("/chans/room")
+
+	l := NewMemoryLocator(store)
+	if got := l.Users([]int64{1}); len(got) != 2 {
+		t.Fatalf("users: %v", got)
+	}
+	if got := l.Channels([]string{"room"}); !reflect.DeepEqual(got, []string{"node-b"}) {
+		t.Fatalf("channels: %v", got)
+	}
+	if got := l.Clients([]int64{1}); len(got) != 0 {
+		t.Fatalf("clients: %v", got)
+	}
+}
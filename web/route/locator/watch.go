@@ -0,0 +1,203 @@
+package locator
+
+import (
+	"context"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	log "github.com/micro/go-micro/v2/logger"
+	"strings"
+	"sync"
+	"time"
+	"tpush/internal"
+	"tpush/internal/tchatroom"
+)
+
+var (
+	watchRetryPeriod = time.Second * 1
+)
+
+// 路由表：注册key -> 节点集合
+type routeTable struct {
+	mu     sync.RWMutex
+	keys   map[string]map[string]struct{}
+	synced map[string]bool // prefix -> 是否已加载快照并处于监听中
+}
+
+// 注册的etcd key为"key/node"，频道名中可能含有"/"，以最后一个"/"分割
+func splitNodeKey(k string) (key, node string, ok bool) {
+	i := strings.LastIndexByte(k, '/')
+	if i <= 0 || i == len(k)-1 {
+		return "", "", false
+	}
+	return k[:i], k[i+1:], true
+}
+
+func (t *routeTable) put(k string) {
+	key, node, ok := splitNodeKey(k)
+	if !ok {
+		return
+	}
+	nodes, ok := t.keys[key]
+	if !ok {
+		nodes = make(map[string]struct{})
+		t.keys[key] = nodes
+	}
+	nodes[node] = struct{}{}
+}
+
+func (t *routeTable) delete(k string) {
+	key, node, ok := splitNodeKey(k)
+	if !ok {
+		return
+	}
+	nodes, ok := t.keys[key]
+	if !ok {
+		return
+	}
+	delete(nodes, node)
+	if len(nodes) == 0 {
+		delete(t.keys, key)
+	}
+}
+
+func (t *routeTable) reset(prefix string, kvs []*mvccpb.KeyValue) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key := range t.keys {
+		if strings.HasPrefix(key, prefix) {
+			delete(t.keys, key)
+		}
+	}
+	for _, kv := range kvs {
+		t.put(string(kv.Key))
+	}
+	t.synced[prefix] = true
+}
+
+func (t *routeTable) apply(events []*clientv3.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, ev := range events {
+		switch ev.Type {
+		case mvccpb.PUT:
+			t.put(string(ev.Kv.Key))
+		case mvccpb.DELETE:
+			t.delete(string(ev.Kv.Key))
+		}
+	}
+}
+
+func (t *routeTable) unsync(prefix string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.synced[prefix] = false
+}
+
+// 返回注册了任一key的节点，该前缀尚未加载快照时ok为false
+// 已加载快照时未命中说明key未在任何节点注册
+func (t *routeTable) lookup(prefix string, keys []string) (nodes map[string]struct{}, ok bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if !t.synced[prefix] {
+		return nil, false
+	}
+	nodes = make(map[string]struct{})
+	for _, key := range keys {
+		for node := range t.keys[key] {
+			nodes[node] = struct{}{}
+		}
+	}
+	return nodes, true
+}
+
+// 通过etcd watch在内存中维护路由表，仅在快照未加载(启动中或监听中断)时回退到直接查询
+type etcdWatchLocator struct {
+	cli   *clientv3.Client
+	table *routeTable
+}
+
+func (l *etcdWatchLocator) watch(ctx context.Context, prefix string) {
+	for ctx.Err() == nil {
+		getCtx, cancel := context.WithTimeout(ctx, LookupTimeout)
+		getRsp, err := l.cli.Get(getCtx, prefix, clientv3.WithPrefix())
+		cancel()
+		if err != nil {
+			log.Errorf("route table load %s err, %v", prefix, err)
+			time.Sleep(watchRetryPeriod)
+			continue
+		}
+		l.table.reset(prefix, getRsp.Kvs)
+		log.Infof("route table loaded %d keys of %s", len(getRsp.Kvs), prefix)
+
+		wch := l.cli.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(getRsp.Header.Revision+1))
+		for wrsp := range wch {
+			if err := wrsp.Err(); err != nil {
+				// 被压缩或取消，重新加载快照
+				log.Errorf("route table watch %s err, %v", prefix, err)
+				break
+			}
+			l.table.apply(wrsp.Events)
+		}
+		l.table.unsync(prefix)
+	}
+}
+
+func (l *etcdWatchLocator) nodes(prefix string, keys []string) []string {
+	nodes, ok := l.table.lookup(prefix, keys)
+	if !ok {
+		nodes = make(map[string]struct{})
+		for node := range internal.GetDistributeNodes(l.cli, keys, LookupTimeout) {
+			nodes[node] = struct{}{}
+		}
+	}
+
+	ret := make([]string, 0, len(nodes))
+	for node := range nodes {
+		ret = append(ret, node)
+	}
+	return ret
+}
+
+func (l *etcdWatchLocator) Users(uids []int64) []string {
+	keys := make([]string, len(uids))
+	for i, uid := range uids {
+		keys[i] = fmt.Sprintf(tchatroom.RegUserKeyFmt, uid)
+	}
+	return l.nodes(tchatroom.RegUserKeyPrefix, keys)
+}
+
+func (l *etcdWatchLocator) Clients(ids []int64) []string {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = fmt.Sprintf(tchatroom.RegClientKeyFmt, id)
+	}
+	return l.nodes(tchatroom.RegClientKeyPrefix, keys)
+}
+
+func (l *etcdWatchLocator) Channels(chans []string) []string {
+	keys := make([]string, len(chans))
+	for i, ch := range chans {
+		keys[i] = fmt.Sprintf(tchatroom.RegChannelKeyFmt, ch)
+	}
+	return l.nodes(tchatroom.RegChannelKeyPrefix, keys)
+}
+
+// 监听随etcd客户端关闭而结束
+func NewEtcdWatchLocator(cli *clientv3.Client) Locator {
+	l := &etcdWatchLocator{
+		cli: cli,
+		table: &routeTable{
+			keys:   make(map[string]map[string]struct{}),
+			synced: make(map[string]bool),
+		},
+	}
+	for _, prefix := range []string{tchatroom.RegUserKeyPrefix, tchatroom.RegClientKeyPrefix, tchatroom.RegChannelKeyPrefix} {
+		go l.watch(cli.Ctx(), prefix)
+	}
+	return l
+}
@@ -3,11 +3,16 @@ package main
 import (
 	"github.com/coreos/etcd/clientv3"
 	"github.com/micro/cli/v2"
+	"github.com/micro/go-micro/v2"
+	"github.com/micro/go-micro/v2/broker"
+	"github.com/micro/go-micro/v2/client/grpc"
 	log "github.com/micro/go-micro/v2/logger"
 	"github.com/micro/go-micro/v2/web"
 	"net/http/pprof"
+	"tpush/internal"
 	"tpush/options"
 	"tpush/web/route/handler"
+	"tpush/web/route/locator"
 )
 
 func main() {
@@ -29,11 +34,54 @@ func main() {
 				EnvVars: []string{"ENABLE_DISTRIBUTE"},
 				Value:   false,
 			},
+			&cli.StringFlag{
+				Name:    "distribute_store",
+				Usage:   "Set the distribute store(etcd|redis)",
+				EnvVars: []string{"DISTRIBUTE_STORE"},
+				Value:   options.DistributeStore,
+			},
+			&cli.StringFlag{
+				Name:    "etcd_address",
+				Usage:   "Set the etcd address of distribute store",
+				EnvVars: []string{"ETCD_ADDRESS"},
+				Value:   options.EtcdAddress,
+			},
+			&cli.StringFlag{
+				Name:    "redis_address",
+				Usage:   "Set the redis address of distribute store",
+				EnvVars: []string{"REDIS_ADDRESS"},
+				Value:   options.RedisAddress,
+			},
+			&cli.StringFlag{
+				Name:    "redis_password",
+				Usage:   "Set the redis password of distribute store",
+				EnvVars: []string{"REDIS_PASSWORD"},
+				Value:   options.RedisPassword,
+			},
+			&cli.StringFlag{
+				Name:    "distribute_mode",
+				Usage:   "Set the distribute mode(route|broker)",
+				EnvVars: []string{"DISTRIBUTE_MODE"},
+				Value:   options.DistributeMode,
+			},
+			&cli.BoolFlag{
+				Name:    "enable_route_cache",
+				Usage:   "enable local route table fed by etcd watch",
+				EnvVars: []string{"ENABLE_ROUTE_CACHE"},
+				Value:   true,
+			},
+			&cli.StringSliceFlag{
+				Name:    "static_nodes",
+				Usage:   "Set the push node ids of static distribute store",
+				EnvVars: []string{"STATIC_NODES"},
+			},
 		),
 	)
 
 	var loglevel log.Level
 	var enable_distribute bool
+	var enable_route_cache bool
+	var static_nodes []string
 
 	// initialise service
 	if err := service.Init(
@@ -45,6 +93,30 @@ func main() {
 			if f := c.String("enable_distribute"); len(f) > 0 {
 				enable_distribute = c.Bool("enable_distribute")
 			}
+
+			if f := c.String("distribute_store"); len(f) > 0 {
+				options.DistributeStore = f
+			}
+
+			if f := c.String("etcd_address"); len(f) > 0 {
+				options.EtcdAddress = f
+			}
+
+			if f := c.String("redis_address"); len(f) > 0 {
+				options.RedisAddress = f
+			}
+
+			options.RedisPassword = c.String("redis_password")
+
+			if f := c.String("distribute_mode"); len(f) > 0 {
+				options.DistributeMode = f
+			}
+
+			if f := c.String("enable_route_cache"); len(f) > 0 {
+				enable_route_cache = c.Bool("enable_route_cache")
+			}
+
+			static_nodes = c.StringSlice("static_nodes")
 		}),
 	); err != nil {
 		log.Fatal(err)
@@ -58,26 +130,55 @@ func main() {
 	}
 
 	// register call handler
-	var c *clientv3.Client = nil
-	if enable_distribute {
-		storeAddress := options.EtcdAddress
-		cfg := clientv3.Config{
-			Endpoints: []string{storeAddress},
-		}
-
-		var err error
-		c, err = clientv3.New(cfg)
-		if err != nil {
+	h := &handler.Handler{}
+	if enable_distribute && options.DistributeMode == options.ModeBroker {
+		// 广播模式无需查询节点
+		if err := broker.Connect(); err != nil {
 			log.Fatal(err)
 			return
 		}
+		h.Publisher = micro.NewEvent(options.PushTopic, grpc.NewClient())
+	} else if enable_distribute {
+		switch options.DistributeStore {
+		case options.StoreEtcd:
+			cfg := clientv3.Config{
+				Endpoints: []string{options.EtcdAddress},
+			}
+			c, err := clientv3.New(cfg)
+			if err != nil {
+				log.Fatal(err)
+				return
+			}
+			if enable_route_cache {
+				h.Locator = locator.NewEtcdWatchLocator(c)
+			} else {
+				h.Locator = locator.NewEtcdLocator(c)
+			}
+		case options.StoreRedis:
+			c := internal.NewCache(options.RedisOptions{
+				Address:  options.RedisAddress,
+				Password: options.RedisPassword,
+			})
+			h.Locator = locator.NewRedisLocator(c)
+		case options.StoreStatic:
+			h.Locator = locator.NewStaticLocator(static_nodes...)
+		default:
+			log.Fatalf("unsupported distribute store: %s", options.DistributeStore)
+			return
+		}
 	}
 
-	h := &handler.Handler{
-		Etcd: c,
-	}
+	service.HandleFunc("/cmd/snd2cli", h.SendToClient)
 	service.HandleFunc("/cmd/snd2usr", h.SendToUser)
 	service.HandleFunc("/cmd/snd2chan", h.SendToChannel)
+	service.HandleFunc("/cmd/online", h.IsOnline)
+	service.HandleFunc("/cmd/usrclis", h.ListClientsOfUser)
+	service.HandleFunc("/cmd/chanmbrs", h.ListChannelMembers)
+	service.HandleFunc("/cmd/clichans", h.ChannelsOfClient)
+	service.HandleFunc("/cmd/cntonline", h.CountOnline)
+	service.HandleFunc("/cmd/subusr", h.SubscribeUser)
+	service.HandleFunc("/cmd/unsubusr", h.UnsubscribeUser)
+	service.HandleFunc("/cmd/kick", h.Kick)
 
 	service.HandleFunc("/debug/pprof/", pprof.Index)
 	service.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -1,10 +1,29 @@
 package proto
 
+// 返回码
+const (
+	CodeOk          = 0
+	CodeNodesFailed = 1 // 部分节点调用失败，结果不完整，失败的节点见failed_nodes
+
+	MsgNodesFailed = "some nodes failed, result may be incomplete"
+)
+
+type SendToClientReq struct {
+	Ids  []int64     `json:"ids"`
+	Data interface{} `json:"data,omitempty"`
+	Id   int64       `json:"id,omitempty"`
+	Uid  int64       `json:"uid,omitempty"`
+	Wait bool        `json:"wait,omitempty"` // 等待写入发送队列后再返回
+	Key  string      `json:"key,omitempty"`  // 合并key，客户端尚未收到的同key数据只保留最新的一条
+}
+
 type SendToUserReq struct {
 	Uids []int64     `json:"uids"`
 	Data interface{} `json:"data,omitempty"`
 	Id   int64       `json:"id,omitempty"`
 	Uid  int64       `json:"uid,omitempty"`
+	Wait bool        `json:"wait,omitempty"`
+	Key  string      `json:"key,omitempty"`
 }
 
 type SendToChannelReq struct {
@@ -12,9 +31,121 @@ type SendToChannelReq struct {
 	Data  interface{} `json:"data,omitempty"`
 	Id    int64       `json:"id,omitempty"`
 	Uid   int64       `json:"uid,omitempty"`
+	Wait  bool        `json:"wait,omitempty"`
+	Key   string      `json:"key,omitempty"`
+}
+
+type TargetStats struct {
+	Target   string `json:"target"`
+	Matched  int    `json:"matched"`
+	Enqueued int    `json:"enqueued"`
+	Dropped  int    `json:"dropped"`
+}
+
+// 各节点投递统计的汇总
+type DeliveryStats struct {
+	Matched  int            `json:"matched"`
+	Enqueued int            `json:"enqueued"`
+	NotFound int            `json:"not_found"`
+	Unknown  int            `json:"unknown"` // 有节点调用失败时未匹配到客户端的目标数，可能在失败的节点上
+	Dropped  int            `json:"dropped"`
+	Targets  []*TargetStats `json:"targets,omitempty"`
 }
 
+// 仅wait为true时等待各节点返回并携带统计
 type SendToRsp struct {
-	Code int    `json:"code"`
-	Msg  string `json:"msg"`
+	Code        int            `json:"code"`
+	Msg         string         `json:"msg"`
+	Stats       *DeliveryStats `json:"stats,omitempty"`
+	FailedNodes []string       `json:"failed_nodes,omitempty"`
+}
+
+type IsOnlineReq struct {
+	Uids []int64 `json:"uids"`
+}
+
+type IsOnlineRsp struct {
+	Code        int      `json:"code"`
+	Msg         string   `json:"msg"`
+	Online      []int64  `json:"online"` // 在线的uid
+	FailedNodes []string `json:"failed_nodes,omitempty"`
+}
+
+type ClientInfo struct {
+	Id  int64 `json:"id"`
+	Uid int64 `json:"uid"`
+}
+
+type ListClientsOfUserReq struct {
+	Uid int64 `json:"uid"`
+}
+
+type ListClientsOfUserRsp struct {
+	Code        int      `json:"code"`
+	Msg         string   `json:"msg"`
+	Ids         []int64  `json:"ids"`
+	FailedNodes []string `json:"failed_nodes,omitempty"`
+}
+
+type ListChannelMembersReq struct {
+	Chan string `json:"chan"`
+}
+
+type ListChannelMembersRsp struct {
+	Code        int           `json:"code"`
+	Msg         string        `json:"msg"`
+	Members     []*ClientInfo `json:"members"`
+	FailedNodes []string      `json:"failed_nodes,omitempty"`
+}
+
+type ChannelsOfClientReq struct {
+	Id int64 `json:"id"`
+}
+
+type ChannelsOfClientRsp struct {
+	Code        int      `json:"code"`
+	Msg         string   `json:"msg"`
+	Chans       []string `json:"chans"`
+	FailedNodes []string `json:"failed_nodes,omitempty"`
+}
+
+// 各节点之和，同一用户在多个节点登录时会被重复计数
+type CountOnlineRsp struct {
+	Code        int      `json:"code"`
+	Msg         string   `json:"msg"`
+	Clients     int64    `json:"clients"`
+	Users       int64    `json:"users"`
+	FailedNodes []string `json:"failed_nodes,omitempty"`
+}
+
+type SubscribeUserReq struct {
+	Uids    []int64  `json:"uids"`
+	Chans   []string `json:"chans"`
+	Persist bool     `json:"persist,omitempty"` // 之后登录的连接也自动进入频道，保存在共享存储中直至取消订阅
+}
+
+type UnsubscribeUserReq struct {
+	Uids  []int64  `json:"uids"`
+	Chans []string `json:"chans"`
+}
+
+type SubscribeRsp struct {
+	Code        int      `json:"code"`
+	Msg         string   `json:"msg"`
+	Clients     int      `json:"clients"` // 受影响的连接数
+	FailedNodes []string `json:"failed_nodes,omitempty"`
+}
+
+type KickReq struct {
+	Ids    []int64  `json:"ids,omitempty"`
+	Uids   []int64  `json:"uids,omitempty"`
+	Chans  []string `json:"chans,omitempty"`
+	Code   int32    `json:"code"` // 通知客户端的原因码
+	Reason string   `json:"reason,omitempty"`
+}
+
+type KickRsp struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	Clients int    `json:"clients"` // 被断开的连接数
 }